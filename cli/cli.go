@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"os/signal"
 	"strings"
 )
 
@@ -12,16 +13,22 @@ type ProcInout struct {
 	Stdout io.Writer
 	Stderr io.Writer
 	Env    EnvFunc
+	Signal SignalFunc
 }
 
 type EnvFunc func(name string) string
 
+// SignalFunc relays the incoming signals to ch until the returned function is called. The default behaviors of the
+// signals such as exiting the process are disabled while relaying.
+type SignalFunc func(ch chan<- os.Signal, sigs ...os.Signal) (stop func())
+
 func NewProcInout() *ProcInout {
 	return &ProcInout{
 		Stdin:  os.Stdin,
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 		Env:    os.Getenv,
+		Signal: NewSignalFunc(),
 	}
 }
 
@@ -31,6 +38,7 @@ func StubProcInout() *ProcInout {
 		Stdout: io.Discard,
 		Stderr: io.Discard,
 		Env:    func(name string) string { return "" },
+		Signal: func(chan<- os.Signal, ...os.Signal) func() { return func() {} },
 	}
 }
 
@@ -39,6 +47,8 @@ type ProcInoutSpy struct {
 	Stdout *bytes.Buffer
 	Stderr *bytes.Buffer
 	Env    map[string]string
+	// Signals is the signals to relay to the command.
+	Signals chan os.Signal
 }
 
 func (s *ProcInoutSpy) NewProcInout() *ProcInout {
@@ -47,15 +57,17 @@ func (s *ProcInoutSpy) NewProcInout() *ProcInout {
 		Stdout: s.Stdout,
 		Stderr: s.Stderr,
 		Env:    NewEnvFunc(s.Env),
+		Signal: NewSpySignalFunc(s.Signals),
 	}
 }
 
 func SpyProcInout(stdin ...string) *ProcInoutSpy {
 	return &ProcInoutSpy{
-		Stdin:  strings.NewReader(strings.Join(stdin, "\n")),
-		Stdout: &bytes.Buffer{},
-		Stderr: &bytes.Buffer{},
-		Env:    make(map[string]string),
+		Stdin:   strings.NewReader(strings.Join(stdin, "\n")),
+		Stdout:  &bytes.Buffer{},
+		Stderr:  &bytes.Buffer{},
+		Env:     make(map[string]string),
+		Signals: make(chan os.Signal, 1),
 	}
 }
 
@@ -71,4 +83,33 @@ func NewEnvFunc(env map[string]string) EnvFunc {
 	return func(name string) string {
 		return env[name]
 	}
-}
\ No newline at end of file
+}
+
+func NewSignalFunc() SignalFunc {
+	return func(ch chan<- os.Signal, sigs ...os.Signal) func() {
+		signal.Notify(ch, sigs...)
+		return func() { signal.Stop(ch) }
+	}
+}
+
+// NewSpySignalFunc returns a SignalFunc that relays the signals sent to signals regardless of sigs.
+func NewSpySignalFunc(signals <-chan os.Signal) SignalFunc {
+	return func(ch chan<- os.Signal, _ ...os.Signal) func() {
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case sig := <-signals:
+					select {
+					case ch <- sig:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		return func() { close(done) }
+	}
+}
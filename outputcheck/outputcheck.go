@@ -0,0 +1,119 @@
+package outputcheck
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatAny   Format = ""
+	FormatJSON  Format = "json"
+	FormatJSONL Format = "jsonl"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatAny, FormatJSON, FormatJSONL:
+		return Format(s), nil
+	default:
+		return FormatAny, fmt.Errorf("ParseFormat: format must be one of json or jsonl: %q", s)
+	}
+}
+
+// Conditions are what an output file must satisfy in addition to its existence.
+type Conditions struct {
+	NonEmpty bool
+	// Newer requires the output file to be modified after the input file.
+	Newer bool
+	// ModifiedSince requires the output file to be modified at or after the time in seconds if not zero.
+	ModifiedSince time.Time
+	Format        Format
+}
+
+// ErrNotSatisfied is returned by Check when the output file does not satisfy the conditions.
+var ErrNotSatisfied = errors.New("output does not satisfy the conditions")
+
+// Check returns nil if the output file exists and satisfies the conditions.
+// It returns an error wrapping ErrNotSatisfied if not, or another error if it cannot tell.
+func Check(outputPath string, inputPath string, c Conditions) error {
+	outputStat, err := os.Stat(outputPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Check: %w: %q does not exist", ErrNotSatisfied, outputPath)
+		}
+		return fmt.Errorf("Check: failed to stat output: %w", err)
+	}
+
+	if outputStat.IsDir() {
+		return fmt.Errorf("Check: %w: %q is a directory", ErrNotSatisfied, outputPath)
+	}
+
+	if c.NonEmpty && outputStat.Size() == 0 {
+		return fmt.Errorf("Check: %w: %q is empty", ErrNotSatisfied, outputPath)
+	}
+
+	if c.Newer {
+		inputStat, err := os.Stat(inputPath)
+		if err != nil {
+			return fmt.Errorf("Check: failed to stat input: %w", err)
+		}
+		if !outputStat.ModTime().After(inputStat.ModTime()) {
+			return fmt.Errorf("Check: %w: %q is not newer than %q", ErrNotSatisfied, outputPath, inputPath)
+		}
+	}
+
+	if !c.ModifiedSince.IsZero() && outputStat.ModTime().Before(c.ModifiedSince.Truncate(time.Second)) {
+		return fmt.Errorf("Check: %w: %q is not modified since %s", ErrNotSatisfied, outputPath, c.ModifiedSince.Format(time.RFC3339))
+	}
+
+	switch c.Format {
+	case FormatAny:
+		return nil
+	case FormatJSON:
+		bs, err := os.ReadFile(outputPath)
+		if err != nil {
+			return fmt.Errorf("Check: failed to read output: %w", err)
+		}
+		if !json.Valid(bs) {
+			return fmt.Errorf("Check: %w: %q is not a valid JSON", ErrNotSatisfied, outputPath)
+		}
+		return nil
+	case FormatJSONL:
+		bs, err := os.ReadFile(outputPath)
+		if err != nil {
+			return fmt.Errorf("Check: failed to read output: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(bs))
+		scanner.Buffer(nil, len(bs)+1)
+		n := 0
+		records := 0
+		for scanner.Scan() {
+			n++
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return fmt.Errorf("Check: %w: line %d of %q is not a valid JSON", ErrNotSatisfied, n, outputPath)
+			}
+			records++
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("Check: failed to scan output: %w", err)
+		}
+		// An empty output is likely left by a crashed command rather than written with no records.
+		if records == 0 {
+			return fmt.Errorf("Check: %w: %q has no JSON Lines records", ErrNotSatisfied, outputPath)
+		}
+		return nil
+	default:
+		panic(fmt.Sprintf("unknown format: %q", c.Format))
+	}
+}
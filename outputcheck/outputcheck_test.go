@@ -0,0 +1,132 @@
+package outputcheck
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	testCases := map[string]struct {
+		output       *string
+		outputOlder  bool
+		conditions   Conditions
+		expectedDone bool
+	}{
+		"not exist": {
+			output:       nil,
+			conditions:   Conditions{},
+			expectedDone: false,
+		},
+		"exist": {
+			output:       ptr(""),
+			conditions:   Conditions{},
+			expectedDone: true,
+		},
+		"empty but non-empty required": {
+			output:       ptr(""),
+			conditions:   Conditions{NonEmpty: true},
+			expectedDone: false,
+		},
+		"non-empty": {
+			output:       ptr("x"),
+			conditions:   Conditions{NonEmpty: true},
+			expectedDone: true,
+		},
+		"newer": {
+			output:       ptr("x"),
+			conditions:   Conditions{Newer: true},
+			expectedDone: true,
+		},
+		"older": {
+			output:       ptr("x"),
+			outputOlder:  true,
+			conditions:   Conditions{Newer: true},
+			expectedDone: false,
+		},
+		"modified since": {
+			output:       ptr("x"),
+			conditions:   Conditions{ModifiedSince: time.Now().Add(-time.Minute)},
+			expectedDone: true,
+		},
+		"modified before": {
+			output:       ptr("x"),
+			outputOlder:  true,
+			conditions:   Conditions{ModifiedSince: time.Now().Add(-time.Minute)},
+			expectedDone: false,
+		},
+		"valid JSON": {
+			output:       ptr(`{"category": "A"}`),
+			conditions:   Conditions{Format: FormatJSON},
+			expectedDone: true,
+		},
+		"truncated JSON": {
+			output:       ptr(`{"category": "A"`),
+			conditions:   Conditions{Format: FormatJSON},
+			expectedDone: false,
+		},
+		"valid JSONL": {
+			output:       ptr("{\"a\": 1}\n{\"a\": 2}\n"),
+			conditions:   Conditions{Format: FormatJSONL},
+			expectedDone: true,
+		},
+		"truncated JSONL": {
+			output:       ptr("{\"a\": 1}\n{\"a\": "),
+			conditions:   Conditions{Format: FormatJSONL},
+			expectedDone: false,
+		},
+		"empty JSONL": {
+			output:       ptr(""),
+			conditions:   Conditions{Format: FormatJSONL},
+			expectedDone: false,
+		},
+		"blank JSONL": {
+			output:       ptr("\n  \n"),
+			conditions:   Conditions{Format: FormatJSONL},
+			expectedDone: false,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			inputPath := filepath.Join(tmpDir, "input.tsv")
+			outputPath := filepath.Join(tmpDir, "output.json")
+			if err := os.WriteFile(inputPath, []byte("input"), 0644); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if tc.output != nil {
+				if err := os.WriteFile(outputPath, []byte(*tc.output), 0644); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				inputTime := time.Now().Add(-time.Hour)
+				outputTime := time.Now()
+				if tc.outputOlder {
+					inputTime, outputTime = outputTime, inputTime
+				}
+				if err := os.Chtimes(inputPath, inputTime, inputTime); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if err := os.Chtimes(outputPath, outputTime, outputTime); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+
+			err := Check(outputPath, inputPath, tc.conditions)
+			if tc.expectedDone {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+			} else {
+				if !errors.Is(err, ErrNotSatisfied) {
+					t.Errorf("expected ErrNotSatisfied, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,107 @@
+package pathpattern
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var variableRegexp = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Pattern is a path pattern such as "./input/{name}.tsv". "{name}" is a variable that matches any string.
+type Pattern struct {
+	source    string
+	regexp    *regexp.Regexp
+	variables []string
+}
+
+func Parse(source string) (*Pattern, error) {
+	sb := strings.Builder{}
+	sb.WriteString("^")
+
+	variables := make([]string, 0)
+	seen := make(map[string]struct{})
+	last := 0
+	for _, loc := range variableRegexp.FindAllStringSubmatchIndex(source, -1) {
+		name := source[loc[2]:loc[3]]
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("Parse: duplicated variable %q in %q", name, source)
+		}
+		seen[name] = struct{}{}
+		variables = append(variables, name)
+
+		sb.WriteString(regexp.QuoteMeta(source[last:loc[0]]))
+		sb.WriteString("(?P<")
+		sb.WriteString(name)
+		sb.WriteString(">.*)")
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(source[last:]))
+	sb.WriteString("$")
+
+	r, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("Parse: %w", err)
+	}
+
+	return &Pattern{source: source, regexp: r, variables: variables}, nil
+}
+
+func (p *Pattern) String() string {
+	return p.source
+}
+
+// Variables returns the variable names in the order of appearance.
+func (p *Pattern) Variables() []string {
+	return p.variables
+}
+
+// Match returns the values of the variables if the path matches the pattern.
+func (p *Pattern) Match(path string) (map[string]string, bool) {
+	m := p.regexp.FindStringSubmatch(path)
+	if m == nil {
+		return nil, false
+	}
+	values := make(map[string]string, len(p.variables))
+	for i, name := range p.regexp.SubexpNames() {
+		if name != "" {
+			values[name] = m[i]
+		}
+	}
+	return values, true
+}
+
+// Render replaces the variables in the pattern with the values.
+func (p *Pattern) Render(values map[string]string) string {
+	return variableRegexp.ReplaceAllStringFunc(p.source, func(s string) string {
+		return values[s[1:len(s)-1]]
+	})
+}
+
+// Mapping maps paths matching From to paths rendered by To.
+type Mapping struct {
+	From *Pattern
+	To   *Pattern
+}
+
+func NewMapping(from, to *Pattern) (*Mapping, error) {
+	defined := make(map[string]struct{}, len(from.variables))
+	for _, name := range from.variables {
+		defined[name] = struct{}{}
+	}
+	for _, name := range to.variables {
+		if _, ok := defined[name]; !ok {
+			return nil, fmt.Errorf("NewMapping: variable %q in %q is not defined in %q", name, to.source, from.source)
+		}
+	}
+	return &Mapping{From: from, To: to}, nil
+}
+
+// Map returns the mapped path, or false if the path does not match From.
+func (m *Mapping) Map(path string) (string, bool) {
+	values, ok := m.From.Match(path)
+	if !ok {
+		return "", false
+	}
+	return m.To.Render(values), true
+}
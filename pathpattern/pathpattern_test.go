@@ -0,0 +1,94 @@
+package pathpattern
+
+import (
+	"testing"
+)
+
+func TestMappingMap(t *testing.T) {
+	testCases := map[string]struct {
+		from       string
+		to         string
+		path       string
+		expected   string
+		expectedOk bool
+	}{
+		"match": {
+			from:       "./input/{name}.tsv",
+			to:         "./output/{name}.json",
+			path:       "./input/a.tsv",
+			expected:   "./output/a.json",
+			expectedOk: true,
+		},
+		"match with nested directories": {
+			from:       "./input/{name}.tsv",
+			to:         "./output/{name}.json",
+			path:       "./input/x/y.tsv",
+			expected:   "./output/x/y.json",
+			expectedOk: true,
+		},
+		"several variables": {
+			from:       "./input/{dir}/{name}.tsv",
+			to:         "./output/{name}-{dir}.json",
+			path:       "./input/x/y.tsv",
+			expected:   "./output/y-x.json",
+			expectedOk: true,
+		},
+		"metacharacters are literal": {
+			from:       "./in.put/{name}.tsv",
+			to:         "{name}",
+			path:       "./inXput/a.tsv",
+			expected:   "",
+			expectedOk: false,
+		},
+		"not match": {
+			from:       "./input/{name}.tsv",
+			to:         "./output/{name}.json",
+			path:       "./input/a.csv",
+			expected:   "",
+			expectedOk: false,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			from, err := Parse(tc.from)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			to, err := Parse(tc.to)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			m, err := NewMapping(from, to)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			actual, ok := m.Map(tc.path)
+			if ok != tc.expectedOk {
+				t.Errorf("expected ok to be %t, got %t", tc.expectedOk, ok)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNewMappingUndefinedVariable(t *testing.T) {
+	from, err := Parse("./input/{name}.tsv")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	to, err := Parse("./output/{dir}/{name}.json")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := NewMapping(from, to); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestParseDuplicatedVariable(t *testing.T) {
+	if _, err := Parse("./{name}/{name}.tsv"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
@@ -0,0 +1,84 @@
+package replstr
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Context is the values that replacement strings are expanded with.
+type Context struct {
+	// Line is the input line.
+	Line string
+	// Seq is the 1-origin sequence number of the input line.
+	Seq int
+	// Slot is the 1-origin worker slot that processes the input line, or 0 if not processed by workers.
+	Slot int
+}
+
+// Expand replaces the following replacement strings in s like GNU parallel:
+//
+//	{}    the input line
+//	{.}   the input line without extension
+//	{/}   basename of the input line
+//	{//}  dirname of the input line
+//	{/.}  basename of the input line without extension
+//	{#}   sequence number of the input line
+//	{%}   worker slot of the input line
+//	{q}   the input line quoted for POSIX shells
+func Expand(s string, ctx Context) string {
+	return expand(s, ctx, func(s string) string { return s })
+}
+
+// ExpandShell is like Expand but quotes the values derived from the input line for POSIX shells, so that s can be
+// executed as a shell script safely whatever the input line is. {q} is the same as {} in s.
+func ExpandShell(s string, ctx Context) string {
+	return expand(s, ctx, ShellQuote)
+}
+
+func expand(s string, ctx Context, quote func(string) string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	base := filepath.Base(ctx.Line)
+	return strings.NewReplacer(
+		"{}", quote(ctx.Line),
+		"{.}", quote(trimExt(ctx.Line)),
+		"{/}", quote(base),
+		"{//}", quote(dir(ctx.Line)),
+		"{/.}", quote(trimExt(base)),
+		"{#}", strconv.Itoa(ctx.Seq),
+		"{%}", strconv.Itoa(ctx.Slot),
+		"{q}", ShellQuote(ctx.Line),
+	).Replace(s)
+}
+
+// ExpandAll applies Expand to each of ss.
+func ExpandAll(ss []string, ctx Context) []string {
+	expanded := make([]string, len(ss))
+	for i, s := range ss {
+		expanded[i] = Expand(s, ctx)
+	}
+	return expanded
+}
+
+// ShellQuote quotes s with single quotes so that POSIX shells interpret it as a single word literally.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func trimExt(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// dir is like filepath.Dir but keeps the path uncleaned as GNU parallel does.
+func dir(path string) string {
+	i := strings.LastIndex(path, string(filepath.Separator))
+	if i < 0 {
+		return "."
+	}
+	if i == 0 {
+		return path[:1]
+	}
+	return path[:i]
+}
@@ -0,0 +1,146 @@
+package replstr
+
+import (
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		ctx      Context
+		expected string
+	}{
+		"no replacement strings": {
+			s:        "echo hello",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 1},
+			expected: "echo hello",
+		},
+		"line": {
+			s:        "{}",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 1},
+			expected: "./input/a.tsv",
+		},
+		"without extension": {
+			s:        "{.}.json",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 1},
+			expected: "./input/a.json",
+		},
+		"basename": {
+			s:        "{/}",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 1},
+			expected: "a.tsv",
+		},
+		"dirname": {
+			s:        "{//}",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 1},
+			expected: "./input",
+		},
+		"basename without extension": {
+			s:        "./output/{/.}.json",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 1},
+			expected: "./output/a.json",
+		},
+		"dirname without directory": {
+			s:        "{//}",
+			ctx:      Context{Line: "a.tsv", Seq: 1},
+			expected: ".",
+		},
+		"sequence number": {
+			s:        "{#}-{/}",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 3},
+			expected: "3-a.tsv",
+		},
+		"worker slot": {
+			s:        "{%}",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 3, Slot: 2},
+			expected: "2",
+		},
+		"several replacement strings": {
+			s:        "{//}/{/.}.{#}.{%}",
+			ctx:      Context{Line: "./input/a.tsv", Seq: 3, Slot: 2},
+			expected: "./input/a.3.2",
+		},
+		"quoted": {
+			s:        "cat {q}",
+			ctx:      Context{Line: `a"; rm -rf ~; ".md`, Seq: 1},
+			expected: `cat 'a"; rm -rf ~; ".md'`,
+		},
+		"dot in directory": {
+			s:        "{.}",
+			ctx:      Context{Line: "./in.put/a", Seq: 1},
+			expected: "./in.put/a",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual := Expand(tc.s, tc.ctx)
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExpandShell(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		ctx      Context
+		expected string
+	}{
+		"line": {
+			s:        "basename {}",
+			ctx:      Context{Line: "./a;echo PWNED>pwned.txt;.tsv", Seq: 1},
+			expected: "basename './a;echo PWNED>pwned.txt;.tsv'",
+		},
+		"derived values": {
+			s:        "echo {/.} {//} {#}",
+			ctx:      Context{Line: "./in put/it's.tsv", Seq: 3},
+			expected: `echo 'it'\''s' './in put' 3`,
+		},
+		"quoted": {
+			s:        "cat {q}",
+			ctx:      Context{Line: "a b", Seq: 1},
+			expected: "cat 'a b'",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual := ExpandShell(tc.s, tc.ctx)
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		expected string
+	}{
+		"empty": {
+			s:        "",
+			expected: "''",
+		},
+		"plain": {
+			s:        "a.md",
+			expected: "'a.md'",
+		},
+		"metacharacters": {
+			s:        "$(rm -rf ~) `id` \"a b\"",
+			expected: "'$(rm -rf ~) `id` \"a b\"'",
+		},
+		"single quotes": {
+			s:        "it's",
+			expected: `'it'\''s'`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual := ShellQuote(tc.s)
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
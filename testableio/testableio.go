@@ -2,8 +2,13 @@ package testableio
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 type OpenFileFunc func(path string, flag int, perm os.FileMode) (io.WriteCloser, error)
@@ -30,8 +35,11 @@ func (n *NopWriteCloser) Close() error {
 	return nil
 }
 
+// SpyOpenFileFunc is an in-memory file system shared by its OpenFileFunc, RenameFunc, RemoveFunc and ExistsFunc. It is
+// safe for concurrent use, but each file must be written by one goroutine at a time.
 type SpyOpenFileFunc struct {
-	m map[string]*bytes.Buffer
+	mu sync.Mutex
+	m  map[string]*bytes.Buffer
 }
 
 func NewSpyOpenFileFunc() *SpyOpenFileFunc {
@@ -39,6 +47,8 @@ func NewSpyOpenFileFunc() *SpyOpenFileFunc {
 }
 
 func (s *SpyOpenFileFunc) Written() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	m := make(map[string]string)
 	for path, w := range s.m {
 		m[path] = w.String()
@@ -48,6 +58,8 @@ func (s *SpyOpenFileFunc) Written() map[string]string {
 
 func (s *SpyOpenFileFunc) OpenFileFunc() OpenFileFunc {
 	return func(path string, _ int, _ os.FileMode) (io.WriteCloser, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
 		w, ok := s.m[path]
 		if !ok {
 			w = bytes.NewBuffer(nil)
@@ -56,3 +68,140 @@ func (s *SpyOpenFileFunc) OpenFileFunc() OpenFileFunc {
 		return NewNopWriteCloser(w), nil
 	}
 }
+
+type RenameFunc func(oldPath, newPath string) error
+
+func NewRenameFunc() RenameFunc {
+	return os.Rename
+}
+
+type RemoveFunc func(path string) error
+
+func NewRemoveFunc() RemoveFunc {
+	return os.Remove
+}
+
+type MkdirAllFunc func(path string, perm os.FileMode) error
+
+func NewMkdirAllFunc() MkdirAllFunc {
+	return os.MkdirAll
+}
+
+type StatFunc func(path string) (os.FileInfo, error)
+
+func NewStatFunc() StatFunc {
+	return os.Stat
+}
+
+type ReadFileFunc func(path string) ([]byte, error)
+
+func NewReadFileFunc() ReadFileFunc {
+	return os.ReadFile
+}
+
+type ReadDirFunc func(path string) ([]os.DirEntry, error)
+
+func NewReadDirFunc() ReadDirFunc {
+	return os.ReadDir
+}
+
+type ExistsFunc func(path string) (bool, error)
+
+func NewExistsFunc() ExistsFunc {
+	return func(path string) (bool, error) {
+		if _, err := os.Stat(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+func (s *SpyOpenFileFunc) RenameFunc() RenameFunc {
+	return func(oldPath, newPath string) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w, ok := s.m[oldPath]
+		if !ok {
+			return &os.PathError{Op: "rename", Path: oldPath, Err: os.ErrNotExist}
+		}
+		delete(s.m, oldPath)
+		s.m[newPath] = w
+		return nil
+	}
+}
+
+func (s *SpyOpenFileFunc) RemoveFunc() RemoveFunc {
+	return func(path string) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.m[path]; !ok {
+			return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+		}
+		delete(s.m, path)
+		return nil
+	}
+}
+
+func (s *SpyOpenFileFunc) ExistsFunc() ExistsFunc {
+	return func(path string) (bool, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.m[path]
+		return ok, nil
+	}
+}
+
+// MkdirAllFunc returns a MkdirAllFunc that does nothing, because the spy has no directories.
+func (s *SpyOpenFileFunc) MkdirAllFunc() MkdirAllFunc {
+	return func(string, os.FileMode) error {
+		return nil
+	}
+}
+
+// AtomicFile is a file written to a temporary file and renamed to the path on Commit, so that readers never see
+// a partially written file.
+type AtomicFile struct {
+	w       io.WriteCloser
+	path    string
+	tmpPath string
+	rename  RenameFunc
+	remove  RemoveFunc
+}
+
+func CreateAtomicFile(path string, openFileFunc OpenFileFunc, renameFunc RenameFunc, removeFunc RemoveFunc) (*AtomicFile, error) {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%08x.tmp", filepath.Base(path), rand.Uint32()))
+	w, err := openFileFunc(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("CreateAtomicFile: failed to create temporary file: %w", err)
+	}
+	return &AtomicFile{w: w, path: path, tmpPath: tmpPath, rename: renameFunc, remove: removeFunc}, nil
+}
+
+func (f *AtomicFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+// Commit closes the temporary file and renames it to the path.
+func (f *AtomicFile) Commit() error {
+	if err := f.w.Close(); err != nil {
+		_ = f.remove(f.tmpPath)
+		return fmt.Errorf("AtomicFile.Commit: failed to close temporary file: %w", err)
+	}
+	if err := f.rename(f.tmpPath, f.path); err != nil {
+		_ = f.remove(f.tmpPath)
+		return fmt.Errorf("AtomicFile.Commit: failed to rename temporary file: %w", err)
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file.
+func (f *AtomicFile) Abort() error {
+	_ = f.w.Close()
+	if err := f.remove(f.tmpPath); err != nil {
+		return fmt.Errorf("AtomicFile.Abort: failed to remove temporary file: %w", err)
+	}
+	return nil
+}
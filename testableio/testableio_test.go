@@ -0,0 +1,59 @@
+package testableio
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAtomicFile(t *testing.T) {
+	testCases := map[string]struct {
+		commit   bool
+		expected map[string]string
+	}{
+		"commit": {
+			commit:   true,
+			expected: map[string]string{"out/a.json": "new", "out/b.json": "old"},
+		},
+		"abort": {
+			commit:   false,
+			expected: map[string]string{"out/b.json": "old"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := NewSpyOpenFileFunc()
+			w, err := spy.OpenFileFunc()("out/b.json", os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			io.WriteString(w, "old")
+
+			f, err := CreateAtomicFile("out/a.json", spy.OpenFileFunc(), spy.RenameFunc(), spy.RemoveFunc())
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			io.WriteString(f, "new")
+
+			if exists, _ := spy.ExistsFunc()("out/a.json"); exists {
+				t.Error("expected the file not to exist before commit")
+			}
+
+			if tc.commit {
+				err = f.Commit()
+			} else {
+				err = f.Abort()
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(spy.Written(), tc.expected) {
+				t.Error(cmp.Diff(tc.expected, spy.Written()))
+			}
+		})
+	}
+}
@@ -13,6 +13,8 @@ prepare() {
     (cd "$BASE_DIR"
         go build -o ./tests/bin_fake/stdinsub ./tools/stdinsub/main.go
         go build -o ./tests/bin_fake/stdinsubst ./tools/stdinsubst/main.go
+        go build -o ./tests/bin_fake/stdinmap ./tools/stdinmap/main.go
+        go build -o ./tests/bin_fake/stdinpending ./tools/stdinpending/main.go
         git clean -fdx ./tests
         mkdir -p ./tests/prompt ./tests/output
     )
@@ -79,7 +81,7 @@ main() {
         find ./output -name '*.json' -print0 > ./output_files
 
         # 3. Convert output paths to input paths.
-        parallel -0 <./output_files bash -c 'printf "{}" | sed -e "s|^\./output/|./input/|" -e "s|\.json$|.tsv|"' > ./input_files.processed
+        stdinmap -0 -r <./output_files './input/{name}.tsv' './output/{name}.json' > ./input_files.processed
 
         # 4. Subtract processed files from input files.
         stdinsub -0 <./input_files ./input_files.processed >./input_files.unprocessed
@@ -103,7 +105,34 @@ main() {
 
         # You can combine the above steps into a single command.
         find ./input -name '*.tsv' -print0 \
-            | stdinsub -0 <(find ./output -name '*.json' -print0 | sed -z -e "s|^\./output/|./input/|" -e "s|\.json$|.tsv|") \
+            | stdinsub -0 <(find ./output -name '*.json' -print0 | stdinmap -0 -r './input/{name}.tsv' './output/{name}.json') \
+            | parallel -0 ./prompt_generator "{}" \
+            | parallel -j3 -0 'claude -dangerously-skip-permissions -p < "{}"'
+
+        set +x
+        clean
+    )
+
+    (cd "$BASE_DIR/tests"
+        set -x
+        echo "====== TEST 5 ======"
+
+        # You can replace the prompt generator script with the batch mode of stdinsubst.
+        find ./input -name '*.tsv' -print0 \
+            | stdinsubst -0 -f ./prompt_template.md -o ./prompt -t '{/.}.md' "%%INPUT_TSV%%" "{}" "%%OUTPUT%%" "literal:./output/{/.}.json" \
+            | parallel -j3 -0 'claude -dangerously-skip-permissions -p < "{}"'
+
+        set +x
+        clean
+    )
+
+    (cd "$BASE_DIR/tests"
+        set -x
+        echo "====== TEST 6 ======"
+
+        # You can skip inputs whose outputs already exist without listing the outputs.
+        find ./input -name '*.tsv' -print0 \
+            | stdinpending -0 -e -f json './output/{/.}.json' \
             | parallel -0 ./prompt_generator "{}" \
             | parallel -j3 -0 'claude -dangerously-skip-permissions -p < "{}"'
 
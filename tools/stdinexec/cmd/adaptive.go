@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AdaptivePolicy is how to adapt the number of concurrent attempts to rate limits.
+type AdaptivePolicy struct {
+	// ExitCodes is the exit codes of rate-limited attempts.
+	ExitCodes []int
+	// StderrPattern matches the stderr of rate-limited attempts. Nil means no pattern.
+	StderrPattern *regexp.Regexp
+	// Cooldown is the duration to pause starting attempts after a rate limit.
+	Cooldown time.Duration
+	// IncreaseAfter is the number of consecutive successes to add a worker back after.
+	IncreaseAfter int
+}
+
+// Enabled returns whether any rate limit detection is configured.
+func (p AdaptivePolicy) Enabled() bool {
+	return len(p.ExitCodes) > 0 || p.StderrPattern != nil
+}
+
+// RateLimited returns whether the failed attempt hit a rate limit.
+func (p AdaptivePolicy) RateLimited(attempt Attempt) bool {
+	if attempt.Kind != FailureExited {
+		return false
+	}
+	if slices.Contains(p.ExitCodes, attempt.ExitCode) {
+		return true
+	}
+	return p.StderrPattern != nil && p.StderrPattern.Match(attempt.Stderr)
+}
+
+// ConcurrencyChange is a change of the concurrency limit.
+type ConcurrencyChange struct {
+	Time   time.Time `json:"time"`
+	From   int       `json:"from"`
+	To     int       `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// Concurrency limits the number of concurrent attempts. On a rate limit, it halves the limit and pauses starting
+// attempts for the cooldown, and after consecutive successes, it adds one back up to the maximum. Rate limits of
+// attempts started before the last decrease do not halve it again, because they hit the same limit. Nil means no limit
+// other than the number of workers.
+type Concurrency struct {
+	mu          sync.Mutex
+	policy      AdaptivePolicy
+	now         func() time.Time
+	max         int
+	limit       int
+	active      int
+	successes   int
+	pausedUntil time.Time
+	decreasedAt time.Time
+	// changed is closed and replaced when an attempt may be able to start.
+	changed chan struct{}
+	Changes []ConcurrencyChange
+}
+
+// NewConcurrency returns a Concurrency starting at ceiling. It returns nil if the policy is not enabled.
+func NewConcurrency(policy AdaptivePolicy, ceiling int, now func() time.Time) *Concurrency {
+	if !policy.Enabled() {
+		return nil
+	}
+	return &Concurrency{
+		policy:  policy,
+		now:     now,
+		max:     ceiling,
+		limit:   ceiling,
+		changed: make(chan struct{}),
+		Changes: make([]ConcurrencyChange, 0),
+	}
+}
+
+// Acquire waits until an attempt can start or ctx is canceled. Release must be called after the attempt.
+func (c *Concurrency) Acquire(ctx context.Context) error {
+	if c == nil {
+		return ctx.Err()
+	}
+	for {
+		c.mu.Lock()
+		wait := c.pausedUntil.Sub(c.now())
+		if wait <= 0 && c.active < c.limit {
+			c.active++
+			c.mu.Unlock()
+			return nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		if err := waitChange(ctx, changed, wait); err != nil {
+			return fmt.Errorf("Concurrency.Acquire: %w", err)
+		}
+	}
+}
+
+// waitChange waits until changed is closed, the pause of wait ends if positive, or ctx is canceled.
+func waitChange(ctx context.Context, changed <-chan struct{}, wait time.Duration) error {
+	var paused <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		paused = timer.C
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-paused:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release ends the attempt and adapts the limit to it. It returns the change of the limit, or nil if not changed.
+func (c *Concurrency) Release(attempt Attempt) *ConcurrencyChange {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.notify()
+	c.active--
+
+	if c.policy.RateLimited(attempt) {
+		c.successes = 0
+		if attempt.Start.Before(c.decreasedAt) {
+			return nil
+		}
+		c.decreasedAt = c.now()
+		c.pausedUntil = c.decreasedAt.Add(c.policy.Cooldown)
+		return c.change(max(1, c.limit/2), fmt.Sprintf("rate limited (exit status %d)", attempt.ExitCode))
+	}
+
+	if attempt.Err != nil {
+		c.successes = 0
+		return nil
+	}
+	c.successes++
+	if c.successes < c.policy.IncreaseAfter || c.limit >= c.max {
+		return nil
+	}
+	c.successes = 0
+	return c.change(c.limit+1, fmt.Sprintf("%d consecutive successes", c.policy.IncreaseAfter))
+}
+
+// change sets the limit and records the change. The caller must hold the lock.
+func (c *Concurrency) change(limit int, reason string) *ConcurrencyChange {
+	if limit == c.limit {
+		return nil
+	}
+	change := ConcurrencyChange{Time: c.now(), From: c.limit, To: limit, Reason: reason}
+	c.limit = limit
+	c.Changes = append(c.Changes, change)
+	return &change
+}
+
+// notify wakes the waiting attempts up. The caller must hold the lock.
+func (c *Concurrency) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// History returns the changes of the limit, or nil if not adaptive.
+func (c *Concurrency) History() []ConcurrencyChange {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.Changes)
+}
@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/testableio"
+)
+
+// CacheOptions is how to cache the results of the commands.
+type CacheOptions struct {
+	// Dir is the directory of the cache, or empty if not cached.
+	Dir string
+	// Env is the names of the environment variables included in the cache key.
+	Env []string
+	// TTL is the duration to replay entries for. Zero means forever.
+	TTL time.Duration
+	// MaxSize is the maximum total size of the entries in bytes. Zero means no limit.
+	MaxSize int64
+	// NoCache runs the commands without replaying the entries, and stores the new results.
+	NoCache bool
+}
+
+// cacheEntryExt is the extension of entry files. Files without it, such as temporary files, are not entries.
+const cacheEntryExt = ".json"
+
+// CacheEntry is the recorded result of a command.
+type CacheEntry struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   []byte `json:"stdout"`
+	Stderr   []byte `json:"stderr"`
+}
+
+// Recording is the output of a command to record to the cache.
+type Recording struct {
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
+}
+
+// Cache stores the results of the commands in files named by the hash of the command line, the environment variables
+// and the stdin. Nil means no cache.
+type Cache struct {
+	options      CacheOptions
+	env          cli.EnvFunc
+	now          func() time.Time
+	openFileFunc testableio.OpenFileFunc
+	renameFunc   testableio.RenameFunc
+	removeFunc   testableio.RemoveFunc
+	statFunc     testableio.StatFunc
+	readFileFunc testableio.ReadFileFunc
+	readDirFunc  testableio.ReadDirFunc
+}
+
+// NewCache returns a Cache of options.Cache with the file functions of the options, and creates its directory. It
+// returns nil if no directory is specified.
+func NewCache(options *Options, env cli.EnvFunc, now func() time.Time) (*Cache, error) {
+	if options.Cache.Dir == "" {
+		return nil, nil
+	}
+	if err := options.MkdirAllFunc(options.Cache.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("NewCache: %w", err)
+	}
+	return &Cache{
+		options:      options.Cache,
+		env:          env,
+		now:          now,
+		openFileFunc: options.OpenFileFunc,
+		renameFunc:   options.RenameFunc,
+		removeFunc:   options.RemoveFunc,
+		statFunc:     options.StatFunc,
+		readFileFunc: options.ReadFileFunc,
+		readDirFunc:  options.ReadDirFunc,
+	}, nil
+}
+
+// Key returns the cache key of the command for the job. The stdin file is read if stdin is StdinFile.
+func (c *Cache) Key(commandAndArgs []string, job Job, stdin StdinMode) (string, error) {
+	h := sha256.New()
+	// Each field is prefixed with its length so that different fields never hash the same.
+	field := func(kind string, s string) {
+		fmt.Fprintf(h, "%s %d\n%s", kind, len(s), s)
+	}
+	for _, arg := range commandAndArgs {
+		field("arg", arg)
+	}
+	for _, name := range c.options.Env {
+		field("env", name+"="+c.env(name))
+	}
+
+	switch stdin {
+	case StdinNone:
+		field("stdin", "")
+	case StdinLine:
+		field("stdin", job.Line)
+	case StdinFile:
+		f, err := os.Open(job.Line)
+		if err != nil {
+			return "", fmt.Errorf("Cache.Key: failed to open input file: %w", err)
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return "", fmt.Errorf("Cache.Key: failed to stat input file: %w", err)
+		}
+		fmt.Fprintf(h, "stdin %d\n", stat.Size())
+		if _, err := io.Copy(h, f); err != nil {
+			return "", fmt.Errorf("Cache.Key: failed to read input file: %w", err)
+		}
+	default:
+		panic(fmt.Sprintf("unknown stdin mode: %q", stdin))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.options.Dir, key+cacheEntryExt)
+}
+
+// Load returns the entry of the key, or nil if not cached, expired, or NoCache is specified.
+func (c *Cache) Load(key string) (*CacheEntry, error) {
+	if c.options.NoCache {
+		return nil, nil
+	}
+
+	path := c.path(key)
+	stat, err := c.statFunc(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cache.Load: %w", err)
+	}
+	if c.expired(stat) {
+		return nil, nil
+	}
+
+	bs, err := c.readFileFunc(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cache.Load: %w", err)
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(bs, &entry); err != nil {
+		return nil, fmt.Errorf("Cache.Load: malformed entry %q: %w", path, err)
+	}
+	return &entry, nil
+}
+
+func (c *Cache) expired(stat os.FileInfo) bool {
+	return c.options.TTL > 0 && c.now().Sub(stat.ModTime()) > c.options.TTL
+}
+
+// Store writes the result of the command to the entry of the key atomically.
+func (c *Cache) Store(key string, exitCode int, recording *Recording) error {
+	f, err := testableio.CreateAtomicFile(c.path(key), c.openFileFunc, c.renameFunc, c.removeFunc)
+	if err != nil {
+		return fmt.Errorf("Cache.Store: %w", err)
+	}
+	entry := CacheEntry{ExitCode: exitCode, Stdout: recording.Stdout.Bytes(), Stderr: recording.Stderr.Bytes()}
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		_ = f.Abort()
+		return fmt.Errorf("Cache.Store: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		return fmt.Errorf("Cache.Store: %w", err)
+	}
+	return nil
+}
+
+// Evict removes the expired entries, and then the oldest entries until the total size is within MaxSize. It returns
+// the number of removed entries.
+func (c *Cache) Evict() (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+
+	dirEntries, err := c.readDirFunc(c.options.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("Cache.Evict: %w", err)
+	}
+
+	var entries []os.FileInfo
+	var size int64
+	removed := 0
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") || filepath.Ext(dirEntry.Name()) != cacheEntryExt {
+			continue
+		}
+		stat, err := dirEntry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return removed, fmt.Errorf("Cache.Evict: %w", err)
+		}
+		if c.expired(stat) {
+			if err := c.remove(stat.Name()); err != nil {
+				return removed, err
+			}
+			removed++
+			continue
+		}
+		entries = append(entries, stat)
+		size += stat.Size()
+	}
+
+	if c.options.MaxSize <= 0 {
+		return removed, nil
+	}
+	slices.SortFunc(entries, func(a, b os.FileInfo) int { return a.ModTime().Compare(b.ModTime()) })
+	for _, entry := range entries {
+		if size <= c.options.MaxSize {
+			break
+		}
+		if err := c.remove(entry.Name()); err != nil {
+			return removed, err
+		}
+		removed++
+		size -= entry.Size()
+	}
+	return removed, nil
+}
+
+func (c *Cache) remove(name string) error {
+	if err := c.removeFunc(filepath.Join(c.options.Dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Cache.remove: %w", err)
+	}
+	return nil
+}
+
+// Attempt returns the attempt of the cached result.
+func (e *CacheEntry) Attempt() Attempt {
+	attempt := Attempt{ExitCode: e.ExitCode, Stderr: e.Stderr, Cached: true}
+	if e.ExitCode != 0 {
+		attempt.Kind = FailureExited
+		attempt.Err = fmt.Errorf("CacheEntry.Attempt: cached command exited with %d", e.ExitCode)
+	}
+	return attempt
+}
+
+// Replay writes the cached output as the command did. The stdout is written to stdout if not nil, or to out otherwise.
+func (e *CacheEntry) Replay(stdout io.Writer, out *JobOutput) error {
+	if stdout != nil {
+		if _, err := stdout.Write(e.Stdout); err != nil {
+			return fmt.Errorf("CacheEntry.Replay: %w", err)
+		}
+	} else {
+		replayLines(e.Stdout, out.StdoutLine)
+	}
+	replayLines(e.Stderr, out.StderrLine)
+	return nil
+}
+
+func replayLines(bs []byte, writeLine func(string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	scanner.Buffer(nil, len(bs)+1)
+	for scanner.Scan() {
+		writeLine(scanner.Text())
+	}
+}
+
+// replay replays the cached result of the key if any, and returns false if not cached. The cached result is not
+// replayed if the expected output does not satisfy the post-condition, so that the command writes it again. The output
+// file written by the replay is removed then, so that it is not left if the command fails.
+func (r *Run) replay(key string, outputPath string, expectPath string, out *JobOutput, events *JobEvents) (Attempt, bool) {
+	if r.Cache == nil || key == "" {
+		return Attempt{}, false
+	}
+
+	start := time.Now()
+	entry, err := r.Cache.Load(key)
+	if err != nil {
+		r.Output.Stderrf("Cache: %s\n", err)
+		return Attempt{}, false
+	}
+	if entry == nil {
+		return Attempt{}, false
+	}
+
+	events.Emit(Event{Type: EventStarted, Cached: true})
+	attempt := runToOutput(outputPath, r.Options, func(stdout io.Writer) Attempt {
+		// The stdout is checked before written, so that it is not written twice when the command runs again. The output
+		// file is checked after written because it may be the expected output.
+		if stdout == nil {
+			if checked := r.Options.PostCondition.Check(entry.Attempt(), expectPath); checked.Kind == FailurePostCondition {
+				return checked
+			}
+		}
+		if err := entry.Replay(stdout, out); err != nil {
+			return Attempt{ExitCode: -1, Cached: true, Kind: FailureError, Err: fmt.Errorf("Run.replay: %w", err)}
+		}
+		return entry.Attempt()
+	})
+	attempt = r.Options.PostCondition.Check(attempt, expectPath)
+	if attempt.Kind == FailurePostCondition {
+		if outputPath != "" {
+			if err := r.Options.RemoveFunc(outputPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				r.Output.Stderrf("Cache: %s\n", fmt.Errorf("Run.replay: failed to remove replayed output: %w", err))
+			}
+		}
+		return Attempt{}, false
+	}
+	attempt.Start = start
+	attempt.Duration = time.Since(start)
+	return attempt, true
+}
+
+// cacheable returns whether the result of the attempt is final for the command and the stdin, that is, it succeeded or
+// failed in a way that is neither retried nor a rate limit.
+func (r *Run) cacheable(attempt Attempt) bool {
+	switch attempt.Kind {
+	case FailureNone:
+		return true
+	case FailureExited:
+		if r.Options.Adaptive.RateLimited(attempt) {
+			return false
+		}
+		return r.Options.RetryPolicy.MaxAttempts <= 1 || !r.Options.RetryPolicy.Retryable(attempt)
+	default:
+		return false
+	}
+}
+
+// ParseSize parses a size in bytes with an optional suffix K, M or G in powers of 1024, such as "512M".
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}}
+	unit := int64(1)
+	number := s
+	for _, u := range units {
+		if rest, ok := strings.CutSuffix(strings.ToUpper(s), u.suffix); ok {
+			number, unit = rest, u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("ParseSize: must be a non-negative integer with an optional suffix K, M or G: %q", s)
+	}
+	return n * unit, nil
+}
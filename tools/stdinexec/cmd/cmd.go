@@ -1,42 +1,35 @@
 package cmd
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"os/exec"
-	"slices"
+	"os"
 	"strconv"
-	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Kuniwak/ai-cli-tools/cli"
-	"github.com/Kuniwak/ai-cli-tools/lines"
+	"github.com/Kuniwak/ai-cli-tools/replstr"
 	"github.com/Kuniwak/ai-cli-tools/version"
 	"golang.org/x/sync/errgroup"
 )
 
-type Errors []error
-
-func (e Errors) Error() string {
-	sb := strings.Builder{}
-	for _, err := range e {
-		sb.WriteString(err.Error())
-		sb.WriteString("\n")
-	}
-	return sb.String()
-}
-
 func MainCommandByArgs(args []string, inout *cli.ProcInout) int {
 	options, err := ParseOptions(args, inout)
 	if err != nil {
 		fmt.Fprintln(inout.Stderr, err)
-		return 1
+		return ExitRunnerError
 	}
 	if err := MainCommandByOptions(options, inout); err != nil {
 		fmt.Fprintln(inout.Stderr, err)
-		return 1
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitStatus
+		}
+		return ExitRunnerError
 	}
-	return 0
+	return ExitOK
 }
 
 func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
@@ -51,107 +44,419 @@ func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
 		return nil
 	}
 
-	ch := make(chan string)
-	var eg errgroup.Group
+	start := time.Now()
+
+	validatesLine := false
+	if options.Strict {
+		var err error
+		validatesLine, err = UsesUnquotedLineInScript(options.CommandAndArgs)
+		if err != nil {
+			return fmt.Errorf("MainCommandByOptions: refused by strict mode: %w", err)
+		}
+	}
+
+	var jobLog *JobLog
+	succeeded := make(map[string]struct{})
+	if options.JobLog != "" {
+		flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if options.Resume {
+			var err error
+			succeeded, err = ReadSucceededInputs(options.JobLog)
+			if err != nil {
+				return fmt.Errorf("MainCommandByOptions: %w", err)
+			}
+			flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		w, err := options.OpenFileFunc(options.JobLog, flag, 0644)
+		if err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to open job log: %w", err)
+		}
+		jobLog = NewJobLog(w)
+		defer jobLog.Close()
+	}
+
+	cache, err := NewCache(options, inout.Env, time.Now)
+	if err != nil {
+		return fmt.Errorf("MainCommandByOptions: %w", err)
+	}
+	if _, err := cache.Evict(); err != nil {
+		return fmt.Errorf("MainCommandByOptions: %w", err)
+	}
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	halter := NewHalter(ctx, options.Halt)
+	defer halter.Close()
+
+	out := NewOutput(inout)
+	report := NewReport(jobLog)
+	progress := NewProgress(options.Parallel, time.Now)
+
+	sigs := make(chan os.Signal, 1)
+	stopSignals := inout.Signal(sigs, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	done := make(chan struct{})
+	defer close(done)
+	go handleSignals(sigs, done, halter, out)
+
+	var events *EventLog
+	if options.Events != "" || options.EventsFD != 0 {
+		w, err := openEvents(options)
+		if err != nil {
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+		events = NewEventLog(w, time.Now)
+		defer events.Close()
+	}
+
+	var trace *Trace
+	if options.Trace != "" {
+		trace = NewTrace(start, options.Parallel)
+	}
+
+	source, err := NewSource(options, succeeded, report.AddUnfinished)
+	if err != nil {
+		return fmt.Errorf("MainCommandByOptions: %w", err)
+	}
+	defer source.Close()
+
+	run := &Run{
+		Options:       options,
+		Report:        report,
+		Halter:        halter,
+		Progress:      progress,
+		Limiter:       NewTokenBucket(options.RateLimit, options.Burst, time.Now),
+		Concurrency:   NewConcurrency(options.Adaptive, options.Parallel, time.Now),
+		Cache:         cache,
+		Source:        source,
+		Events:        events,
+		Trace:         trace,
+		Output:        out,
+		ValidatesLine: validatesLine,
+	}
+
+	ch := make(chan Job)
 	eg.Go(func() error {
 		defer close(ch)
 
-		scanner := bufio.NewScanner(options.Reader)
-		scanFunc := lines.NewScanFunc(options.Null)
-		scanner.Split(scanFunc)
-		for scanner.Scan() {
-			ch <- scanner.Text()
+		var unfinishErr error
+		send := func(job Job) bool {
+			progress.Queue()
+			events.Emit(Event{Type: EventQueued, Seq: job.Seq, Input: job.Line})
+			select {
+			case ch <- job:
+				return true
+			case <-halter.Dispatch.Done():
+				unfinishErr = run.unfinish(job)
+				return false
+			}
 		}
-
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("MainCommandByOptions: failed to scan lines: %w", err)
+		if err := source.Feed(halter.Dispatch, send); err != nil {
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+		if unfinishErr != nil {
+			return fmt.Errorf("MainCommandByOptions: %w", unfinishErr)
 		}
 
+		if halter.Dispatch.Err() == nil {
+			progress.EndInput()
+		}
 		return nil
 	})
 
 	for i := 0; i < options.Parallel; i++ {
-		eg.Go(executeCommand(i, options.Parallel, ch, slices.Clone(options.CommandAndArgs), inout))
+		eg.Go(executeCommand(i, run, ch))
+	}
+
+	progressDone := make(chan struct{})
+	progressReported := make(chan struct{})
+	if options.Progress {
+		go func() {
+			defer close(progressReported)
+			ReportProgress(progress, out, IsTerminal(inout.Stderr), options.ProgressInterval, progressDone)
+		}()
+	} else {
+		close(progressReported)
 	}
 
-	if err := eg.Wait(); err != nil {
+	err = eg.Wait()
+	close(progressDone)
+	<-progressReported
+	if err != nil {
 		return fmt.Errorf("MainCommandByOptions: failed to wait for commands to complete: %w", err)
 	}
+
+	if evicted, err := cache.Evict(); err != nil {
+		return fmt.Errorf("MainCommandByOptions: %w", err)
+	} else if evicted > 0 {
+		fmt.Fprintf(inout.Stderr, "Cache: evicted %d entries\n", evicted)
+	}
+
+	if err := events.Close(); err != nil {
+		return fmt.Errorf("MainCommandByOptions: %w", err)
+	}
+	if err := report.JobLog.Close(); err != nil {
+		return fmt.Errorf("MainCommandByOptions: failed to close job log: %w", err)
+	}
+
+	report.WriteFailures(inout.Stderr)
+	report.WriteUnfinished(inout.Stderr)
+
+	runErr := jobsError(options, halter, report)
+	exitStatus := ExitOK
+	var exitErr *ExitError
+	if errors.As(runErr, &exitErr) {
+		exitStatus = exitErr.ExitStatus
+	}
+
+	summary := NewSummary(report, run.Concurrency, time.Since(start), exitStatus)
+	summary.Write(inout.Stderr)
+	if options.SummaryJSON != "" {
+		w, err := options.OpenFileFunc(options.SummaryJSON, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to open summary: %w", err)
+		}
+		if err := summary.WriteJSON(w); err != nil {
+			_ = w.Close()
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to close summary: %w", err)
+		}
+	}
+
+	if trace != nil {
+		w, err := options.OpenFileFunc(options.Trace, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to open trace: %w", err)
+		}
+		if err := trace.Write(w); err != nil {
+			_ = w.Close()
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to close trace: %w", err)
+		}
+	}
+
+	return runErr
+}
+
+// jobsError returns an ExitError if some jobs failed or the run was halted or interrupted, or nil otherwise.
+func jobsError(options *Options, halter *Halter, report *Report) error {
+	if sig := halter.Interrupted(); sig != nil {
+		exitStatus := ExitJobsFailed
+		if s, ok := sig.(syscall.Signal); ok {
+			exitStatus = exitSignalBase + int(s)
+		}
+		return &ExitError{ExitStatus: exitStatus, Err: fmt.Errorf("MainCommandByOptions: interrupted by %s", sig)}
+	}
+	if halter.Halted() {
+		finished, failed := report.Counts()
+		return &ExitError{ExitStatus: ExitJobsFailed, Err: fmt.Errorf("MainCommandByOptions: halted by %s after %d of %d jobs failed", options.Halt, failed, finished)}
+	}
+	if failed := report.Failed(); len(failed) > 0 {
+		return &ExitError{ExitStatus: ExitJobsFailed, Err: fmt.Errorf("MainCommandByOptions: %d jobs failed", len(failed))}
+	}
 	return nil
 }
 
-func executeCommand(i int, parallel int, lines <-chan string, commandAndArgsOrig []string, inout *cli.ProcInout) func() error {
+// Run is the state of a run shared by the workers.
+type Run struct {
+	Options  *Options
+	Report   *Report
+	Halter   *Halter
+	Progress *Progress
+	// Limiter is nil if the rate is not limited.
+	Limiter *TokenBucket
+	// Concurrency is nil if the concurrency is not adaptive.
+	Concurrency *Concurrency
+	// Cache is nil if the results are not cached.
+	Cache  *Cache
+	Source Source
+	// Events is nil if no events are written.
+	Events *EventLog
+	// Trace is nil if no trace is recorded.
+	Trace  *Trace
+	Output *Output
+	// ValidatesLine refuses unsafe input lines because they are substituted into shell scripts without quoting.
+	ValidatesLine bool
+}
+
+// unfinish records the job received but not finished, and returns it to the source.
+func (r *Run) unfinish(job Job) error {
+	r.Report.AddUnfinished(job)
+	if err := r.Source.Release(job); err != nil {
+		return fmt.Errorf("Run.unfinish: %w", err)
+	}
+	return nil
+}
+
+// acquire waits until an attempt can start under the adaptive concurrency and the rate limit, or ctx is canceled.
+func (r *Run) acquire(ctx context.Context) error {
+	if err := r.Concurrency.Acquire(ctx); err != nil {
+		return fmt.Errorf("Run.acquire: %w", err)
+	}
+	if err := r.Limiter.Wait(ctx); err != nil {
+		r.Concurrency.Release(Attempt{Kind: FailureCanceled, Err: err})
+		return fmt.Errorf("Run.acquire: %w", err)
+	}
+	return nil
+}
+
+// Job is an input line to execute the command for.
+type Job struct {
+	// Seq is the 1-origin sequence number of the line in the input, or of the claim if queued.
+	Seq  int
+	Line string
+	// ID is the name of the job in the queue, or empty if not queued.
+	ID string
+}
+
+func executeCommand(i int, run *Run, jobs <-chan Job) func() error {
 	return func() error {
-		es := make([]error, 0)
-		for line := range lines {
-			commandAndArgs := slices.Clone(commandAndArgsOrig)
-			for j, arg := range commandAndArgs {
-				commandAndArgs[j] = strings.ReplaceAll(arg, "{}", line)
+		options := run.Options
+		retryPolicy := options.RetryPolicy
+		finish := func(job Job, result JobResult) error {
+			run.Progress.Finish(result)
+			if err := run.Report.Add(result); err != nil {
+				return fmt.Errorf("executeCommand: %w", err)
 			}
-			cmd := exec.Command(commandAndArgs[0], commandAndArgs[1:]...)
-
-			stdoutReader, _ := cmd.StdoutPipe()
-			stderrReader, _ := cmd.StderrPipe()
+			if err := run.Source.Finish(job, result); err != nil {
+				return fmt.Errorf("executeCommand: %w", err)
+			}
+			if run.Halter.Observe(run.Report.Counts()) {
+				run.Output.Stderrf("Halting by %s: %q failed\n", options.Halt, result.Line)
+			}
+			return nil
+		}
 
-			if err := cmd.Start(); err != nil {
-				es = append(es, fmt.Errorf("MainCommandByOptions: failed to execute command: %w (%d %#v)", err, i, commandAndArgs))
+		for job := range jobs {
+			// The job may be received just before halting.
+			if run.Halter.Dispatch.Err() != nil {
+				if err := run.unfinish(job); err != nil {
+					return fmt.Errorf("executeCommand: %w", err)
+				}
 				continue
 			}
 
-			var eg errgroup.Group
-			eg.Go(func() error {
-				scanner := bufio.NewScanner(stdoutReader)
-				scanner.Split(bufio.ScanLines)
-				for scanner.Scan() {
-					text := scanner.Text()
-					if parallel == 1 {
-						fmt.Fprintln(inout.Stdout, text)
-					} else {
-						io.WriteString(inout.Stdout, strconv.Itoa(i))
-						io.WriteString(inout.Stdout, "\t")
-						io.WriteString(inout.Stdout, text)
-						io.WriteString(inout.Stdout, "\n")
+			if run.ValidatesLine {
+				if err := ValidateLine(job.Line); err != nil {
+					if err := finish(job, JobResult{Seq: job.Seq, Line: job.Line, ExitCode: -1, Kind: FailureError, Err: err}); err != nil {
+						return err
 					}
+					continue
 				}
-				if err := scanner.Err(); err != nil {
-					return fmt.Errorf("MainCommandByOptions: failed to scan stdout: %w", err)
-				}
-				return nil
-			})
-
-			eg.Go(func() error {
-				scanner := bufio.NewScanner(stderrReader)
-				scanner.Split(bufio.ScanLines)
-				for scanner.Scan() {
-					text := scanner.Text()
-					if parallel == 1 {
-						fmt.Fprintln(inout.Stdout, text)
-					} else {
-						io.WriteString(inout.Stdout, strconv.Itoa(i))
-						io.WriteString(inout.Stdout, "\t")
-						io.WriteString(inout.Stdout, text)
-						io.WriteString(inout.Stdout, "\n")
+			}
+
+			ctx := replstr.Context{Line: job.Line, Seq: job.Seq, Slot: i + 1}
+			commandAndArgs := replstr.ExpandAll(options.CommandAndArgs, ctx)
+
+			expectPath := replstr.Expand(options.PostCondition.PathTemplate, ctx)
+
+			var outputPath string
+			if options.OutputTemplate != "" {
+				outputPath = replstr.Expand(options.OutputTemplate, ctx)
+				if !options.Force {
+					exists, err := options.ExistsFunc(outputPath)
+					if err != nil {
+						return fmt.Errorf("executeCommand: failed to check output: %w", err)
+					}
+					if exists {
+						if err := finish(job, JobResult{Seq: job.Seq, Line: job.Line, Skipped: true}); err != nil {
+							return err
+						}
+						continue
 					}
 				}
-				if err := scanner.Err(); err != nil {
-					return fmt.Errorf("MainCommandByOptions: failed to scan stderr: %w", err)
-				}
-				return nil
-			})
+			}
+
+			var cacheKey string
+			if run.Cache != nil {
+				// The job fails in the attempt if the key cannot be computed, such as when the input file is missing.
+				cacheKey, _ = run.Cache.Key(commandAndArgs, job, options.Stdin)
+			}
 
-			if err := eg.Wait(); err != nil {
-				es = append(es, fmt.Errorf("MainCommandByOptions: failed to wait for stdout and stderr to complete: %w", err))
+			jobOut := run.Output.NewJobOutput(outputPrefix(i, job, options), options.Group)
+			events := run.Events.Job(job, i+1)
+			events.Attempt = 1
+			// Replayed results are neither limited by the rate nor the concurrency because no commands run.
+			if attempt, ok := run.replay(cacheKey, outputPath, expectPath, jobOut, events); ok {
+				events.Ended(attempt)
+				run.Trace.Add(i+1, job, 1, attempt)
+				run.Progress.Start()
+				jobOut.Flush()
+				result := JobResult{Seq: job.Seq, Line: job.Line, Attempts: 1, Start: attempt.Start, Duration: attempt.Duration, ExitCode: attempt.ExitCode, Kind: attempt.Kind, Err: attempt.Err, Cached: true}
+				if err := finish(job, result); err != nil {
+					return err
+				}
 				continue
 			}
 
-			if err := cmd.Wait(); err != nil {
-				es = append(es, fmt.Errorf("MainCommandByOptions: failed to wait for command to complete: %w (%d %#v)", err, i, commandAndArgs))
+			// The first attempt waits before the job starts, so that halting does not leave it started.
+			if err := run.acquire(run.Halter.Dispatch); err != nil {
+				if err := run.unfinish(job); err != nil {
+					return fmt.Errorf("executeCommand: %w", err)
+				}
 				continue
 			}
-		}
-		if len(es) > 0 {
-			return Errors(es)
+
+			run.Progress.Start()
+			result := JobResult{Seq: job.Seq, Line: job.Line}
+			for {
+				result.Attempts++
+				events.Attempt = result.Attempts
+				events.PID = 0
+				attempt := runAttempt(run, i, job, commandAndArgs, outputPath, expectPath, cacheKey, jobOut, events)
+				events.Ended(attempt)
+				run.Trace.Add(i+1, job, result.Attempts, attempt)
+				if change := run.Concurrency.Release(attempt); change != nil {
+					run.Output.Stderrf("Concurrency: %d -> %d: %s\n", change.From, change.To, change.Reason)
+				}
+				if result.Attempts == 1 {
+					result.Start = attempt.Start
+					result.NotStarted = true
+				}
+				result.NotStarted = result.NotStarted && attempt.NotStarted
+				result.Duration += attempt.Duration
+				result.ExitCode = attempt.ExitCode
+				result.Signal = attempt.Signal
+				result.Kind = attempt.Kind
+				result.Err = attempt.Err
+				if attempt.Err == nil || result.Attempts >= retryPolicy.MaxAttempts || !retryPolicy.Retryable(attempt) {
+					break
+				}
+				delay := retryPolicy.Backoff(result.Attempts)
+				run.Output.Stderrf("Retrying %q in %s (attempt %d/%d): %s\n", job.Line, delay, result.Attempts, retryPolicy.MaxAttempts, attempt.Err)
+				events.Emit(Event{Type: EventRetried, Delay: delay.Seconds(), Error: attempt.Err.Error()})
+				select {
+				case <-time.After(delay):
+				case <-run.Halter.Attempts.Done():
+				}
+				if err := run.acquire(run.Halter.Attempts); err != nil {
+					result.Kind = FailureCanceled
+					result.Err = fmt.Errorf("executeCommand: %w", err)
+					break
+				}
+			}
+
+			jobOut.Flush()
+
+			if err := finish(job, result); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 }
+
+// outputPrefix returns the prefix of the output lines of the job. It is the input line if tagged, the worker index if
+// running in parallel, or empty otherwise.
+func outputPrefix(i int, job Job, options *Options) string {
+	if options.Tag {
+		return job.Line
+	}
+	if options.Parallel > 1 {
+		return strconv.Itoa(i)
+	}
+	return ""
+}
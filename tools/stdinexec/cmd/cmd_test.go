@@ -1,11 +1,24 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/testableio"
 	"github.com/Kuniwak/ai-cli-tools/version"
 	"github.com/google/go-cmp/cmp"
 )
@@ -59,6 +72,11 @@ func TestMainCommandByArgsSingle(t *testing.T) {
 			args:           []string{"-0", "echo", "hello", "{}"},
 			expectedStdout: "hello one\nhello two\nhello three\n",
 		},
+		"replacement strings": {
+			stdin:          "./input/a.tsv\n./input/b.tsv\n",
+			args:           []string{"echo", "{.}", "{/}", "{//}", "{/.}", "{#}", "{%}"},
+			expectedStdout: "./input/a a.tsv ./input a 1 1\n./input/b b.tsv ./input b 2 1\n",
+		},
 	}
 
 	for name, tc := range testCases {
@@ -120,3 +138,1592 @@ func TestMainCommandByArgsParallel(t *testing.T) {
 		})
 	}
 }
+
+func TestMainCommandByArgsRetry(t *testing.T) {
+	// The script fails until it has been run more than {fails} times, counting in the file given by the line.
+	script := `n=$(cat "$1"); echo $((n+1)) > "$1"; echo "attempt $n" >&2; [ "$n" -ge "$2" ] || exit "$3"`
+
+	testCases := map[string]struct {
+		fails              int
+		exitCode           int
+		args               []string
+		expectedExitStatus int
+		expectedAttempts   int
+	}{
+		"no retries": {
+			fails:              1,
+			exitCode:           1,
+			args:               []string{},
+			expectedExitStatus: 1,
+			expectedAttempts:   1,
+		},
+		"succeed after retries": {
+			fails:              2,
+			exitCode:           1,
+			args:               []string{"-r", "2"},
+			expectedExitStatus: 0,
+			expectedAttempts:   3,
+		},
+		"exhausted": {
+			fails:              3,
+			exitCode:           1,
+			args:               []string{"-retries", "2"},
+			expectedExitStatus: 1,
+			expectedAttempts:   3,
+		},
+		"retryable exit code": {
+			fails:              1,
+			exitCode:           75,
+			args:               []string{"-r", "2", "-retry-exit-codes", "75"},
+			expectedExitStatus: 0,
+			expectedAttempts:   2,
+		},
+		"non-retryable exit code": {
+			fails:              1,
+			exitCode:           1,
+			args:               []string{"-r", "2", "-retry-exit-codes", "75"},
+			expectedExitStatus: 1,
+			expectedAttempts:   1,
+		},
+		"retryable stderr": {
+			fails:              1,
+			exitCode:           1,
+			args:               []string{"-r", "2", "-retry-stderr", "attempt 0"},
+			expectedExitStatus: 0,
+			expectedAttempts:   2,
+		},
+		"non-retryable stderr": {
+			fails:              1,
+			exitCode:           1,
+			args:               []string{"-r", "2", "-retry-stderr", "overloaded"},
+			expectedExitStatus: 1,
+			expectedAttempts:   1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			counter := filepath.Join(t.TempDir(), "counter")
+			if err := os.WriteFile(counter, []byte("0\n"), 0644); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			args := append(slices.Clone(tc.args), "-retry-delay", "1ms", "sh", "-c", script, "sh", "{}", fmt.Sprint(tc.fails), fmt.Sprint(tc.exitCode))
+			spy := cli.SpyProcInout(counter)
+			exitStatus := MainCommandByArgs(args, spy.NewProcInout())
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+
+			bs, err := os.ReadFile(counter)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			attempts := strings.TrimSpace(string(bs))
+			if attempts != fmt.Sprint(tc.expectedAttempts) {
+				t.Errorf("expected %d attempts, got %s", tc.expectedAttempts, attempts)
+			}
+
+			if tc.expectedExitStatus != 0 && !strings.Contains(spy.Stderr.String(), counter) {
+				t.Errorf("expected stderr to report the failed input, got %q", spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	testCases := map[string]struct {
+		policy   RetryPolicy
+		attempt  int
+		expected time.Duration
+	}{
+		"first": {
+			policy:   RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute},
+			attempt:  1,
+			expected: time.Second,
+		},
+		"doubled": {
+			policy:   RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute},
+			attempt:  3,
+			expected: 4 * time.Second,
+		},
+		"capped": {
+			policy:   RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute},
+			attempt:  10,
+			expected: time.Minute,
+		},
+		"no cap": {
+			policy:   RetryPolicy{BaseDelay: time.Second},
+			attempt:  10,
+			expected: 512 * time.Second,
+		},
+		"no overflow": {
+			policy:   RetryPolicy{BaseDelay: time.Nanosecond},
+			attempt:  100,
+			expected: time.Duration(1 << 62),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			for range 10 {
+				actual := tc.policy.Backoff(tc.attempt)
+				if actual < tc.expected/2 || actual > tc.expected {
+					t.Fatalf("expected a delay in [%s, %s], got %s", tc.expected/2, tc.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsTimeout(t *testing.T) {
+	testCases := map[string]struct {
+		args               []string
+		expectedExitStatus int
+		expectedTimedOut   bool
+	}{
+		"in time": {
+			args:               []string{"-t", "5s", "sh", "-c", "echo {}"},
+			expectedExitStatus: 0,
+			expectedTimedOut:   false,
+		},
+		"timed out": {
+			args:               []string{"-t", "100ms", "sh", "-c", "sleep 5; echo {}"},
+			expectedExitStatus: 1,
+			expectedTimedOut:   true,
+		},
+		"orphaned children": {
+			args:               []string{"-timeout", "100ms", "sh", "-c", "(sleep 5; echo {}) & sleep 5"},
+			expectedExitStatus: 1,
+			expectedTimedOut:   true,
+		},
+		"ignoring SIGTERM": {
+			args:               []string{"-t", "100ms", "-kill-grace", "100ms", "sh", "-c", "trap '' TERM; sleep 5; echo {}"},
+			expectedExitStatus: 1,
+			expectedTimedOut:   true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout("one\n")
+			start := time.Now()
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("expected to finish soon, took %s", elapsed)
+			}
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+			if timedOut := strings.Contains(spy.Stderr.String(), "("+string(FailureTimedOut)+", attempts"); timedOut != tc.expectedTimedOut {
+				t.Errorf("expected timed out to be %t, got %t\n%s", tc.expectedTimedOut, timedOut, spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsJobLogResume(t *testing.T) {
+	tmpDir := t.TempDir()
+	jobLogPath := filepath.Join(tmpDir, "joblog.jsonl")
+	executedPath := filepath.Join(tmpDir, "executed")
+	script := `echo "$1" >> "$2"; [ "$1" != "$3" ]`
+
+	spy := cli.SpyProcInout("one\ntwo\nthree\n")
+	exitStatus := MainCommandByArgs([]string{"-joblog", jobLogPath, "sh", "-c", script, "sh", "{}", executedPath, "two"}, spy.NewProcInout())
+	if exitStatus != 1 {
+		t.Fatalf("expected exit status to be 1, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+
+	records := readJobLog(t, jobLogPath)
+	actual := make(map[string]JobLogRecord)
+	for _, record := range records {
+		actual[record.Input] = record
+	}
+	if len(actual) != 3 {
+		t.Fatalf("expected 3 records, got %#v", records)
+	}
+	if !actual["one"].Succeeded() || actual["one"].Seq != 1 || actual["one"].Attempts != 1 {
+		t.Errorf("expected one to succeed, got %#v", actual["one"])
+	}
+	if actual["two"].Succeeded() || actual["two"].ExitStatus != 1 || actual["two"].Seq != 2 {
+		t.Errorf("expected two to fail with exit status 1, got %#v", actual["two"])
+	}
+
+	spy = cli.SpyProcInout("one\ntwo\nthree\n")
+	exitStatus = MainCommandByArgs([]string{"-joblog", jobLogPath, "-resume", "sh", "-c", script, "sh", "{}", executedPath, "none"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+
+	bs, err := os.ReadFile(executedPath)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	executed := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	slices.Sort(executed)
+	expected := []string{"one", "three", "two", "two"}
+	if !slices.Equal(executed, expected) {
+		t.Error(cmp.Diff(expected, executed))
+	}
+
+	if records := readJobLog(t, jobLogPath); len(records) != 4 {
+		t.Errorf("expected 4 records after resume, got %#v", records)
+	}
+}
+
+type closeErrorWriter struct {
+	bytes.Buffer
+}
+
+func (w *closeErrorWriter) Close() error {
+	return errors.New("disk full")
+}
+
+func TestMainCommandByOptionsCloseError(t *testing.T) {
+	testCases := map[string]struct {
+		args     []string
+		expected string
+	}{
+		"job log": {
+			args:     []string{"-joblog", "joblog.jsonl", "true"},
+			expected: "failed to close job log",
+		},
+		"summary": {
+			args:     []string{"-summary-json", "summary.json", "true"},
+			expected: "failed to close summary",
+		},
+		"trace": {
+			args:     []string{"-trace", "trace.json", "true"},
+			expected: "failed to close trace",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			inout := cli.SpyProcInout("one\n").NewProcInout()
+			options, err := ParseOptions(tc.args, inout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options.OpenFileFunc = func(string, int, os.FileMode) (io.WriteCloser, error) {
+				return &closeErrorWriter{}, nil
+			}
+
+			err = MainCommandByOptions(options, inout)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error to contain %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func readJobLog(t *testing.T, path string) []JobLogRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer f.Close()
+
+	records := make([]JobLogRecord, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record JobLogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestMainCommandByArgsStderr(t *testing.T) {
+	spy := cli.SpyProcInout("one\n")
+	exitStatus := MainCommandByArgs([]string{"sh", "-c", "echo out {}; echo err {} >&2"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+	if spy.Stdout.String() != "out one\n" {
+		t.Errorf("expected stdout to be %q, got %q", "out one\n", spy.Stdout.String())
+	}
+	if !strings.Contains(spy.Stderr.String(), "err one\n") {
+		t.Errorf("expected stderr to contain %q, got %q", "err one\n", spy.Stderr.String())
+	}
+}
+
+func TestMainCommandByArgsGroupTag(t *testing.T) {
+	expectedStdoutOneOf := []string{
+		"one\ta one\none\tb one\ntwo\ta two\ntwo\tb two\n",
+		"two\ta two\ntwo\tb two\none\ta one\none\tb one\n",
+	}
+
+	for i := 1; i <= 5; i++ {
+		t.Run(fmt.Sprintf("group %d", i), func(t *testing.T) {
+			spy := cli.SpyProcInout("one\ntwo\n")
+			exitStatus := MainCommandByArgs([]string{"-p", "2", "-g", "-tag", "sh", "-c", "echo a {}; sleep 0.05; echo b {}"}, spy.NewProcInout())
+			if exitStatus != 0 {
+				t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+			}
+			if !slices.Contains(expectedStdoutOneOf, spy.Stdout.String()) {
+				t.Errorf("expected stdout to be one of %#v, got %q", expectedStdoutOneOf, spy.Stdout.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByOptionsOutputTemplate(t *testing.T) {
+	testCases := map[string]struct {
+		args     []string
+		expected map[string]string
+	}{
+		"skip existing outputs": {
+			args:     []string{"-o", "out/{/.}.json", "echo", "{}"},
+			expected: map[string]string{"out/a.json": "old", "out/b.json": "./in/b.tsv\n"},
+		},
+		"force": {
+			args:     []string{"-o", "out/{/.}.json", "-force", "echo", "{}"},
+			expected: map[string]string{"out/a.json": "./in/a.tsv\n", "out/b.json": "./in/b.tsv\n"},
+		},
+		"parallel": {
+			args:     []string{"-p", "2", "-o", "out/{/.}.json", "-force", "echo", "{}"},
+			expected: map[string]string{"out/a.json": "./in/a.tsv\n", "out/b.json": "./in/b.tsv\n"},
+		},
+		"failed jobs": {
+			args:     []string{"-o", "out/{/.}.json", "-force", "sh", "-c", "echo partial; exit 1"},
+			expected: map[string]string{"out/a.json": "old"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout("./in/a.tsv\n./in/b.tsv\n")
+			inout := spy.NewProcInout()
+			options, err := ParseOptions(tc.args, inout)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			openFileSpy := testableio.NewSpyOpenFileFunc()
+			w, err := openFileSpy.OpenFileFunc()("out/a.json", os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			w.Write([]byte("old"))
+
+			options.OpenFileFunc = openFileSpy.OpenFileFunc()
+			options.RenameFunc = openFileSpy.RenameFunc()
+			options.RemoveFunc = openFileSpy.RemoveFunc()
+			options.MkdirAllFunc = openFileSpy.MkdirAllFunc()
+			options.ExistsFunc = openFileSpy.ExistsFunc()
+
+			_ = MainCommandByOptions(options, inout)
+
+			if !reflect.DeepEqual(openFileSpy.Written(), tc.expected) {
+				t.Error(cmp.Diff(tc.expected, openFileSpy.Written()))
+			}
+			if spy.Stdout.String() != "" {
+				t.Errorf("expected stdout to be empty, got %q", spy.Stdout.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsOutputDirectory(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "output", "nested")
+	spy := cli.SpyProcInout("a\n")
+	exitStatus := MainCommandByArgs([]string{"-o", filepath.Join(outputDir, "{}.txt"), "echo", "{}"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+	bs, err := os.ReadFile(filepath.Join(outputDir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "a\n" {
+		t.Errorf("expected the output to be %q, got %q", "a\n", string(bs))
+	}
+}
+
+func TestMainCommandByArgsStdin(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, `it's a "prompt".md`)
+	if err := os.WriteFile(inputPath, []byte("hello\n"), 0644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	testCases := map[string]struct {
+		stdin          string
+		args           []string
+		expectedStdout string
+	}{
+		"file": {
+			stdin:          inputPath + "\n",
+			args:           []string{"-i", "file", "cat"},
+			expectedStdout: "hello\n",
+		},
+		"line": {
+			stdin:          "one\ntwo\n",
+			args:           []string{"-stdin", "line", "cat"},
+			expectedStdout: "one\ntwo\n",
+		},
+		"none": {
+			stdin:          "one\n",
+			args:           []string{"cat"},
+			expectedStdout: "",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout(tc.stdin)
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if exitStatus != 0 {
+				t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expectedStdout {
+				t.Error(cmp.Diff(tc.expectedStdout, spy.Stdout.String()))
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsStrict(t *testing.T) {
+	testCases := map[string]struct {
+		stdin              string
+		args               []string
+		expectedExitStatus int
+		expectedStdout     string
+		expectedStderr     string
+	}{
+		"quoted": {
+			stdin:              "a\"; echo injected; \".md\nit's\n",
+			args:               []string{"-s", "sh", "-c", "printf '%s\\n' {q}"},
+			expectedExitStatus: 0,
+			expectedStdout:     "a\"; echo injected; \".md\nit's\n",
+		},
+		"unquoted safe line": {
+			stdin:              "./input/a.md\n",
+			args:               []string{"-s", "sh", "-c", "echo \"{}\""},
+			expectedExitStatus: 0,
+			expectedStdout:     "./input/a.md\n",
+		},
+		"unquoted unsafe line": {
+			stdin:              "a\"; echo injected; \".md\n",
+			args:               []string{"-s", "sh", "-c", "echo \"{}\""},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+			expectedStderr:     "unsafe character",
+		},
+		"unquoted basename in combined flag": {
+			stdin:              "./input/$(id).md\n",
+			args:               []string{"-s", "sh", "-ec", "echo {/.}"},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+			expectedStderr:     "unsafe character",
+		},
+		"unquoted in script after other flags": {
+			stdin:              "./input/$(id).md\n",
+			args:               []string{"-s", "env", "/bin/bash", "-e", "-c", "echo {}"},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+			expectedStderr:     "unsafe character",
+		},
+		"unquoted in script after option with value": {
+			stdin:              "./input/$(id).md\n",
+			args:               []string{"-s", "bash", "-o", "pipefail", "-c", "echo {}"},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+			expectedStderr:     "unsafe character",
+		},
+		"unquoted in script after separate flags": {
+			stdin:              "./input/$(id).md\n",
+			args:               []string{"-s", "sh", "-e", "-u", "-c", "echo {}"},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+			expectedStderr:     "unsafe character",
+		},
+		"unknown shell option": {
+			stdin:              "./input/a.md\n",
+			args:               []string{"-s", "bash", "--unknown", "-c", "echo {}"},
+			expectedExitStatus: ExitRunnerError,
+			expectedStdout:     "",
+			expectedStderr:     "unknown shell option",
+		},
+		"script file": {
+			stdin:              "a b.md\n",
+			args:               []string{"-s", "sh", "-e", "/dev/null", "{}"},
+			expectedExitStatus: 0,
+			expectedStdout:     "",
+		},
+		"not in script": {
+			stdin:              "a\"; echo injected; \".md\n",
+			args:               []string{"-s", "echo", "{}"},
+			expectedExitStatus: 0,
+			expectedStdout:     "a\"; echo injected; \".md\n",
+		},
+		"flag of other command ending in c": {
+			stdin:              "a b.md\n",
+			args:               []string{"-s", "find", ".", "-maxdepth", "0", "-exec", "echo", "{}", ";"},
+			expectedExitStatus: 0,
+			expectedStdout:     "a b.md\n",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout(tc.stdin)
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expectedStdout {
+				t.Error(cmp.Diff(tc.expectedStdout, spy.Stdout.String()))
+			}
+			if !strings.Contains(spy.Stderr.String(), tc.expectedStderr) {
+				t.Errorf("expected stderr to contain %q, got %q", tc.expectedStderr, spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsHalt(t *testing.T) {
+	script := "case {} in fail) exit 1;; slow) sleep 5; echo slow;; *) echo {};; esac"
+	testCases := map[string]struct {
+		stdin              string
+		args               []string
+		expectedExitStatus int
+		expectedStdout     string
+		expectedStderr     string
+	}{
+		"never": {
+			stdin:              "fail\nok\n",
+			args:               []string{"sh", "-c", script},
+			expectedExitStatus: 1,
+			expectedStdout:     "ok\n",
+			expectedStderr:     "1 jobs failed",
+		},
+		"soon after failures": {
+			stdin:              "ok\nfail\nok\n",
+			args:               []string{"-halt", "soon,fail=1", "sh", "-c", script},
+			expectedExitStatus: 1,
+			expectedStdout:     "ok\n",
+			expectedStderr:     "halted by soon,fail=1 after 1 of 2 jobs failed",
+		},
+		"soon after percentage": {
+			stdin:              "ok\nok\nfail\nfail\nok\nok\n",
+			args:               []string{"-halt", "soon,fail=50%", "sh", "-c", script},
+			expectedExitStatus: 1,
+			expectedStdout:     "ok\nok\n",
+			expectedStderr:     "halted by soon,fail=50% after 2 of 4 jobs failed",
+		},
+		"now kills running jobs": {
+			stdin:              "slow\nfail\nok\n",
+			args:               []string{"-p", "2", "-kill-grace", "100ms", "-halt", "now,fail=1", "sh", "-c", script},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+			expectedStderr:     "Unfinished inputs (2):\n  \"slow\"\n  \"ok\"\n",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout(tc.stdin)
+			start := time.Now()
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("expected to finish soon, took %s", elapsed)
+			}
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expectedStdout {
+				t.Error(cmp.Diff(tc.expectedStdout, spy.Stdout.String()))
+			}
+			if !strings.Contains(spy.Stderr.String(), tc.expectedStderr) {
+				t.Errorf("expected stderr to contain %q, got %q", tc.expectedStderr, spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestParseHaltPolicy(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		expected HaltPolicy
+	}{
+		"never": {
+			s:        "never",
+			expected: NoHalt,
+		},
+		"soon with failures": {
+			s:        "soon,fail=3",
+			expected: HaltPolicy{When: HaltSoon, Failures: 3},
+		},
+		"now with percentage": {
+			s:        "now,fail=12.5%",
+			expected: HaltPolicy{When: HaltNow, Percent: 12.5},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := ParseHaltPolicy(tc.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Error(cmp.Diff(tc.expected, actual))
+			}
+			if actual.String() != tc.s {
+				t.Errorf("expected %q, got %q", tc.s, actual.String())
+			}
+		})
+	}
+
+	for _, s := range []string{"", "soon", "later,fail=1", "now,fail=0", "now,fail=-1", "now,fail=0%", "now,fail=101%", "now,success=1"} {
+		t.Run(fmt.Sprintf("invalid %q", s), func(t *testing.T) {
+			if _, err := ParseHaltPolicy(s); err == nil {
+				t.Errorf("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsSignal(t *testing.T) {
+	testCases := map[string]struct {
+		args           []string
+		signals        int
+		expectedStdout string
+	}{
+		"forwarded": {
+			args:           []string{"sh", "-c", "trap 'echo interrupted {}; exit 130' INT; sleep 5"},
+			signals:        1,
+			expectedStdout: "interrupted one\n",
+		},
+		"killed by second signal": {
+			args:           []string{"sh", "-c", "trap '' INT; sleep 5; echo {}"},
+			signals:        2,
+			expectedStdout: "",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout("one\ntwo\nthree\n")
+			go func() {
+				for range tc.signals {
+					time.Sleep(300 * time.Millisecond)
+					spy.Signals <- os.Interrupt
+				}
+			}()
+
+			start := time.Now()
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("expected to finish soon, took %s", elapsed)
+			}
+			if exitStatus != 130 {
+				t.Errorf("expected exit status to be 130, got %d\n%s", exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expectedStdout {
+				t.Error(cmp.Diff(tc.expectedStdout, spy.Stdout.String()))
+			}
+			for _, expected := range []string{"interrupted by interrupt", "Unfinished inputs (3):\n  \"one\"\n  \"two\"\n  \"three\"\n"} {
+				if !strings.Contains(spy.Stderr.String(), expected) {
+					t.Errorf("expected stderr to contain %q, got %q", expected, spy.Stderr.String())
+				}
+			}
+			if strings.Contains(spy.Stderr.String(), "Failed inputs") {
+				t.Errorf("expected canceled jobs not to be failed, got %q", spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestProgressString(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	progress := NewProgress(2, func() time.Time { return now })
+
+	for range 5 {
+		progress.Queue()
+	}
+	progress.Start()
+	progress.Start()
+	progress.Finish(JobResult{Attempts: 1, Duration: time.Minute})
+	progress.Finish(JobResult{Attempts: 1, Duration: 3 * time.Minute, Err: errors.New("failed")})
+	progress.Finish(JobResult{Skipped: true})
+	progress.Start()
+	now = start.Add(3 * time.Minute)
+
+	expected := "3/? done, 1 running, 1 failed, 1.0 jobs/min, elapsed 3m0s"
+	if actual := progress.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+
+	progress.EndInput()
+	expected = "3/5 done, 1 running, 1 failed, 1.0 jobs/min, elapsed 3m0s, ETA 2m0s"
+	if actual := progress.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestMainCommandByArgsProgress(t *testing.T) {
+	spy := cli.SpyProcInout("one\ntwo\n")
+	exitStatus := MainCommandByArgs([]string{"-progress", "-progress-interval", "50ms", "sh", "-c", "sleep 0.2; echo {}"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+	if spy.Stdout.String() != "one\ntwo\n" {
+		t.Errorf("expected stdout to be %q, got %q", "one\ntwo\n", spy.Stdout.String())
+	}
+	for _, expected := range []string{"Progress: 0/? done, 1 running, 0 failed", "Progress: 1/2 done, 1 running, 0 failed", "Progress: 2/2 done, 0 running, 0 failed"} {
+		if !strings.Contains(spy.Stderr.String(), expected) {
+			t.Errorf("expected stderr to contain %q, got %q", expected, spy.Stderr.String())
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	bucket := NewTokenBucket(RateLimit{Count: 60, Per: time.Minute}, 2, func() time.Time { return now })
+
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second}
+	for i, e := range expected {
+		if actual := bucket.Reserve(); actual != e {
+			t.Errorf("reservation %d: expected %s, got %s", i, e, actual)
+		}
+	}
+
+	now = start.Add(10 * time.Second)
+	expected = []time.Duration{0, 0, time.Second}
+	for i, e := range expected {
+		if actual := bucket.Reserve(); actual != e {
+			t.Errorf("reservation %d after idling: expected %s, got %s", i, e, actual)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bucket.Wait(ctx); err == nil {
+		t.Error("expected waiting with a canceled context to fail")
+	}
+	if actual := bucket.Reserve(); actual != 2*time.Second {
+		t.Errorf("expected the canceled reservation to be given back, got %s", actual)
+	}
+
+	if actual := (*TokenBucket)(nil).Reserve(); actual != 0 {
+		t.Errorf("expected no limit to never block, got %s", actual)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		expected RateLimit
+	}{
+		"no limit": {
+			s:        "",
+			expected: NoRateLimit,
+		},
+		"per second": {
+			s:        "10/s",
+			expected: RateLimit{Count: 10, Per: time.Second},
+		},
+		"per minute": {
+			s:        "50/m",
+			expected: RateLimit{Count: 50, Per: time.Minute},
+		},
+		"per hour": {
+			s:        "1000/h",
+			expected: RateLimit{Count: 1000, Per: time.Hour},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := ParseRateLimit(tc.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Error(cmp.Diff(tc.expected, actual))
+			}
+			if actual.String() != tc.s {
+				t.Errorf("expected %q, got %q", tc.s, actual.String())
+			}
+		})
+	}
+
+	for _, s := range []string{"10", "0/s", "-1/m", "x/m", "10/d"} {
+		t.Run(fmt.Sprintf("invalid %q", s), func(t *testing.T) {
+			if _, err := ParseRateLimit(s); err == nil {
+				t.Errorf("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsRate(t *testing.T) {
+	spy := cli.SpyProcInout("one\ntwo\nthree\n")
+	start := time.Now()
+	exitStatus := MainCommandByArgs([]string{"-p", "3", "-rate", "10/s", "echo", "{}"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected to be limited to 10 jobs per second, took %s", elapsed)
+	}
+	if lines := strings.Count(spy.Stdout.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines, got %q", spy.Stdout.String())
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	policy := AdaptivePolicy{ExitCodes: []int{75}, Cooldown: 10 * time.Second, IncreaseAfter: 2}
+	concurrency := NewConcurrency(policy, 4, func() time.Time { return now })
+
+	acquirable := func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return concurrency.Acquire(ctx) == nil
+	}
+
+	for i := range 4 {
+		if !acquirable() {
+			t.Fatalf("expected attempt %d to be acquirable", i)
+		}
+	}
+	if acquirable() {
+		t.Fatal("expected no more attempts than the ceiling")
+	}
+
+	change := concurrency.Release(Attempt{ExitCode: 75, Kind: FailureExited, Err: errors.New("rate limited")})
+	if change == nil || change.From != 4 || change.To != 2 {
+		t.Fatalf("expected the limit to be halved, got %#v", change)
+	}
+
+	now = start.Add(11 * time.Second)
+	if acquirable() {
+		t.Fatal("expected no attempts while 3 attempts are active under the limit 2")
+	}
+
+	if change := concurrency.Release(Attempt{}); change != nil {
+		t.Fatalf("expected no change after a success, got %#v", change)
+	}
+	if change := concurrency.Release(Attempt{ExitCode: 1, Kind: FailureExited, Err: errors.New("failed")}); change != nil {
+		t.Fatalf("expected no change after a failure, got %#v", change)
+	}
+	if change := concurrency.Release(Attempt{}); change != nil {
+		t.Fatalf("expected successes interrupted by a failure not to increase the limit, got %#v", change)
+	}
+	if !acquirable() {
+		t.Fatal("expected an attempt to be acquirable after releases")
+	}
+	change = concurrency.Release(Attempt{})
+	if change == nil || change.From != 2 || change.To != 3 {
+		t.Fatalf("expected the limit to be increased, got %#v", change)
+	}
+	if !acquirable() {
+		t.Fatal("expected an attempt to be acquirable under the increased limit")
+	}
+
+	if len(concurrency.Changes) != 2 {
+		t.Errorf("expected 2 changes, got %#v", concurrency.Changes)
+	}
+}
+
+func TestConcurrencySimultaneousRateLimits(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	policy := AdaptivePolicy{ExitCodes: []int{75}, Cooldown: 10 * time.Second, IncreaseAfter: 2}
+	concurrency := NewConcurrency(policy, 8, func() time.Time { return now })
+
+	for range 8 {
+		if err := concurrency.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limited := Attempt{Start: start, ExitCode: 75, Kind: FailureExited, Err: errors.New("rate limited")}
+	now = start.Add(time.Second)
+	change := concurrency.Release(limited)
+	if change == nil || change.From != 8 || change.To != 4 {
+		t.Fatalf("expected the limit to be halved, got %#v", change)
+	}
+	for range 3 {
+		if change := concurrency.Release(limited); change != nil {
+			t.Fatalf("expected attempts started before the decrease not to halve the limit again, got %#v", change)
+		}
+	}
+
+	for range 4 {
+		concurrency.Release(Attempt{Kind: FailureCanceled, Err: context.Canceled})
+	}
+
+	// Attempts started after the decrease hit the new limit.
+	now = start.Add(20 * time.Second)
+	if err := concurrency.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	limited.Start = now
+	now = now.Add(time.Second)
+	change = concurrency.Release(limited)
+	if change == nil || change.From != 4 || change.To != 2 {
+		t.Fatalf("expected the limit to be halved, got %#v", change)
+	}
+}
+
+func TestMainCommandByArgsAdaptive(t *testing.T) {
+	spy := cli.SpyProcInout("one\nlimited\nthree\n")
+	exitStatus := MainCommandByArgs([]string{"-p", "4", "-adaptive-exit-codes", "75", "-adaptive-cooldown", "100ms", "sh", "-c", "test {} != limited || exit 75; echo {}"}, spy.NewProcInout())
+	if exitStatus != 1 {
+		t.Errorf("expected exit status to be 1, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+	for _, expected := range []string{"Concurrency: 4 -> 2: rate limited (exit status 75)", "Concurrency changes (1):\n"} {
+		if !strings.Contains(spy.Stderr.String(), expected) {
+			t.Errorf("expected stderr to contain %q, got %q", expected, spy.Stderr.String())
+		}
+	}
+}
+
+func TestMainCommandByArgsSummary(t *testing.T) {
+	summaryPath := filepath.Join(t.TempDir(), "summary.json")
+	tmpDir := t.TempDir()
+	script := `case {} in
+fail) exit 1;;
+slow) sleep 0.2;;
+timeout) sleep 5;;
+flaky) [ -e "$1/flaky" ] || { touch "$1/flaky"; exit 1; };;
+esac`
+
+	spy := cli.SpyProcInout("ok\nfail\nslow\ntimeout\nflaky\n")
+	exitStatus := MainCommandByArgs([]string{"-p", "5", "-t", "1s", "-r", "1", "-retry-delay", "10ms", "-retry-exit-codes", "1", "-summary-json", summaryPath, "sh", "-c", script, "sh", tmpDir}, spy.NewProcInout())
+	if exitStatus != ExitJobsFailed {
+		t.Errorf("expected exit status to be %d, got %d\n%s", ExitJobsFailed, exitStatus, spy.Stderr.String())
+	}
+
+	expectedLine := "Summary: 3 succeeded, 2 failed (1 timed out), 3 retried, 0 skipped, 0 cached, 0 unfinished in "
+	if !strings.Contains(spy.Stderr.String(), expectedLine) {
+		t.Errorf("expected stderr to contain %q, got %q", expectedLine, spy.Stderr.String())
+	}
+
+	bs, err := os.ReadFile(summaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	if err := json.Unmarshal(bs, &summary); err != nil {
+		t.Fatal(err)
+	}
+	actual := []int{summary.Succeeded, summary.Failed, summary.TimedOut, summary.Retried, summary.Skipped, summary.Unfinished, summary.ExitStatus}
+	expected := []int{3, 2, 1, 3, 0, 0, ExitJobsFailed}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(cmp.Diff(expected, actual))
+	}
+	if len(summary.Slowest) == 0 || summary.Slowest[0].Input != "timeout" || summary.Slowest[0].Attempts != 2 {
+		t.Errorf("expected the slowest job to be the timed out one, got %#v", summary.Slowest)
+	}
+}
+
+func TestNewSummary(t *testing.T) {
+	report := NewReport(nil)
+	results := []JobResult{
+		{Seq: 1, Line: "ok", Attempts: 1, Duration: time.Second},
+		{Seq: 2, Line: "fail", Attempts: 1, Duration: 2 * time.Second, ExitCode: 1, Kind: FailureExited, Err: errors.New("failed")},
+		{Seq: 3, Line: "canceled", Attempts: 1, Duration: 3 * time.Second, ExitCode: -1, Kind: FailureCanceled, Err: errors.New("canceled")},
+		{Seq: 4, Line: "not started", Attempts: 1, ExitCode: -1, Kind: FailureError, Err: errors.New("not found"), NotStarted: true},
+	}
+	for _, result := range results {
+		if err := report.Add(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report.AddUnfinished(Job{Seq: 5, Line: "unread"})
+
+	summary := NewSummary(report, nil, 5*time.Second, ExitJobsFailed)
+	actual := []int{summary.Succeeded, summary.Failed, summary.Unfinished}
+	expected := []int{1, 2, 2}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(cmp.Diff(expected, actual))
+	}
+
+	slowest := make([]string, 0, len(summary.Slowest))
+	for _, job := range summary.Slowest {
+		slowest = append(slowest, job.Input)
+	}
+	if diff := cmp.Diff([]string{"canceled", "fail", "ok"}, slowest); diff != "" {
+		t.Errorf("slowest mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMainCommandByArgsExitStatus(t *testing.T) {
+	testCases := map[string]struct {
+		args     []string
+		expected int
+	}{
+		"all ok": {
+			args:     []string{"true"},
+			expected: ExitOK,
+		},
+		"some jobs failed": {
+			args:     []string{"false"},
+			expected: ExitJobsFailed,
+		},
+		"invalid options": {
+			args:     []string{"-halt", "later", "true"},
+			expected: ExitRunnerError,
+		},
+		"runner error": {
+			args:     []string{"-joblog", filepath.Join(t.TempDir(), "missing", "joblog.jsonl"), "true"},
+			expected: ExitRunnerError,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout("one\n")
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if exitStatus != tc.expected {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expected, exitStatus, spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsPostCondition(t *testing.T) {
+	testCases := map[string]struct {
+		script             string
+		prepare            string
+		args               []string
+		expectedExitStatus int
+		expectedStderr     string
+	}{
+		"written": {
+			script:             `echo '{"a": 1}' > "$1/{}.json"`,
+			args:               []string{"-expect-format", "json"},
+			expectedExitStatus: 0,
+		},
+		"not written": {
+			script:             `true`,
+			expectedExitStatus: 1,
+			expectedStderr:     "(post-condition failed, attempts: 1)",
+		},
+		"invalid format": {
+			script:             `echo '{"a": ' > "$1/{}.json"`,
+			args:               []string{"-expect-format", "json"},
+			expectedExitStatus: 1,
+			expectedStderr:     "is not a valid JSON",
+		},
+		"empty": {
+			script:             `touch "$1/{}.json"`,
+			args:               []string{"-expect-non-empty"},
+			expectedExitStatus: 1,
+			expectedStderr:     "is empty",
+		},
+		"stale": {
+			script:             `true`,
+			prepare:            "stale",
+			args:               []string{"-expect-fresh"},
+			expectedExitStatus: 1,
+			expectedStderr:     "is not modified since",
+		},
+		"retried": {
+			script:             `[ -e "$1/tried" ] && echo '{}' > "$1/{}.json"; touch "$1/tried"`,
+			args:               []string{"-r", "1", "-retry-delay", "10ms", "-retry-exit-codes", "75"},
+			expectedExitStatus: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if tc.prepare == "stale" {
+				stalePath := filepath.Join(tmpDir, "one.json")
+				if err := os.WriteFile(stalePath, []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				staleTime := time.Now().Add(-time.Hour)
+				if err := os.Chtimes(stalePath, staleTime, staleTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := append([]string{"-expect", filepath.Join(tmpDir, "{}.json")}, tc.args...)
+			args = append(args, "sh", "-c", tc.script, "sh", tmpDir)
+			spy := cli.SpyProcInout("one\n")
+			exitStatus := MainCommandByArgs(args, spy.NewProcInout())
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+			if !strings.Contains(spy.Stderr.String(), tc.expectedStderr) {
+				t.Errorf("expected stderr to contain %q, got %q", tc.expectedStderr, spy.Stderr.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsCache(t *testing.T) {
+	testCases := map[string]struct {
+		script             string
+		args               []string
+		secondEnv          string
+		expectedStdout     string
+		expectedRuns       int
+		expectedExitStatus int
+	}{
+		"replayed": {
+			script:             `exit 0`,
+			expectedStdout:     "out-one\n",
+			expectedRuns:       1,
+			expectedExitStatus: 0,
+		},
+		"no cache": {
+			script:             `exit 0`,
+			args:               []string{"-no-cache"},
+			expectedStdout:     "out-one\n",
+			expectedRuns:       2,
+			expectedExitStatus: 0,
+		},
+		"environment variable changed": {
+			script:             `exit 0`,
+			args:               []string{"-cache-env", "MODEL"},
+			secondEnv:          "opus",
+			expectedStdout:     "out-one\n",
+			expectedRuns:       2,
+			expectedExitStatus: 0,
+		},
+		"environment variable not in key": {
+			script:             `exit 0`,
+			secondEnv:          "opus",
+			expectedStdout:     "out-one\n",
+			expectedRuns:       1,
+			expectedExitStatus: 0,
+		},
+		"expired": {
+			script:             `exit 0`,
+			args:               []string{"-cache-ttl", "1ns"},
+			expectedStdout:     "out-one\n",
+			expectedRuns:       2,
+			expectedExitStatus: 0,
+		},
+		"final failure": {
+			script:             `exit 3`,
+			expectedStdout:     "out-one\n",
+			expectedRuns:       1,
+			expectedExitStatus: 1,
+		},
+		"retryable failure": {
+			script:             `exit 3`,
+			args:               []string{"-r", "1", "-retry-delay", "10ms"},
+			expectedStdout:     "out-one\nout-one\n",
+			expectedRuns:       4,
+			expectedExitStatus: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			script := `echo run >> "$1/runs"; echo out-{}; echo err-{} >&2; ` + tc.script
+			args := append([]string{"-cache", filepath.Join(tmpDir, "cache")}, tc.args...)
+			args = append(args, "sh", "-c", script, "sh", tmpDir)
+
+			secondEnv := tc.secondEnv
+			if secondEnv == "" {
+				secondEnv = "sonnet"
+			}
+
+			var stdouts []string
+			for i, env := range []string{"sonnet", secondEnv} {
+				spy := cli.SpyProcInout("one\n")
+				spy.Env["MODEL"] = env
+				exitStatus := MainCommandByArgs(args, spy.NewProcInout())
+				if exitStatus != tc.expectedExitStatus {
+					t.Errorf("expected exit status of run %d to be %d, got %d\n%s", i+1, tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+				}
+				if !strings.Contains(spy.Stderr.String(), "err-one\n") {
+					t.Errorf("expected stderr of run %d to contain %q, got %q", i+1, "err-one\n", spy.Stderr.String())
+				}
+				stdouts = append(stdouts, spy.Stdout.String())
+			}
+
+			if diff := cmp.Diff([]string{tc.expectedStdout, tc.expectedStdout}, stdouts); diff != "" {
+				t.Errorf("stdout mismatch (-want +got):\n%s", diff)
+			}
+
+			bs, err := os.ReadFile(filepath.Join(tmpDir, "runs"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runs := strings.Count(string(bs), "run\n"); runs != tc.expectedRuns {
+				t.Errorf("expected the command to run %d times, got %d", tc.expectedRuns, runs)
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsCacheReplayedOutputRemoved(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "out-one.txt")
+	sidePath := filepath.Join(tmpDir, "side-one")
+	script := `[ -e "$1/fail" ] && exit 1; touch "$1/side-{}"; echo out-{}`
+	args := []string{"-cache", filepath.Join(tmpDir, "cache"), "-o", filepath.Join(tmpDir, "out-{}.txt"), "-expect", filepath.Join(tmpDir, "side-{}"), "sh", "-c", script, "sh", tmpDir}
+
+	spy := cli.SpyProcInout("one\n")
+	if exitStatus := MainCommandByArgs(args, spy.NewProcInout()); exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+
+	// The cached result no longer satisfies the post-condition, and the command fails when run again.
+	for _, path := range []string{outputPath, sidePath} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "fail"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spy = cli.SpyProcInout("one\n")
+	if exitStatus := MainCommandByArgs(args, spy.NewProcInout()); exitStatus != 1 {
+		t.Errorf("expected exit status to be 1, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+	if _, err := os.Stat(outputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the replayed output to be removed, got %v", err)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	options, err := ParseOptions([]string{"-cache", dir, "-cache-ttl", "1h", "-cache-max-size", "200", "true"}, cli.SpyProcInout().NewProcInout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(options, func(string) string { return "" }, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ages := map[string]time.Duration{"expired": 2 * time.Hour, "old": 3 * time.Minute, "middle": 2 * time.Minute, "new": time.Minute}
+	for key, age := range ages {
+		recording := &Recording{}
+		recording.Stdout.WriteString(strings.Repeat("x", 30))
+		if err := cache.Store(key, 0, recording); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, key+".json")
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := cache.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 entries to be removed, got %d", removed)
+	}
+
+	for key, expected := range map[string]bool{"expired": false, "old": false, "middle": true, "new": true} {
+		entry, err := cache.Load(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (entry != nil) != expected {
+			t.Errorf("expected %q to be cached: %t, got %t", key, expected, entry != nil)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	testCases := map[string]struct {
+		input    string
+		expected int64
+		err      bool
+	}{
+		"empty":     {input: "", expected: 0},
+		"bytes":     {input: "512", expected: 512},
+		"kilobytes": {input: "4K", expected: 4 << 10},
+		"megabytes": {input: "512M", expected: 512 << 20},
+		"gigabytes": {input: "1g", expected: 1 << 30},
+		"negative":  {input: "-1M", err: true},
+		"unknown":   {input: "1T", err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := ParseSize(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got %d", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLineSourceFeedCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var sent, unsent []string
+	source := &LineSource{
+		Reader: strings.NewReader("one\ntwo\nthree\n"),
+		Unsent: func(job Job) { unsent = append(unsent, job.Line) },
+	}
+	err := source.Feed(ctx, func(job Job) bool {
+		sent = append(sent, job.Line)
+		cancel()
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"one"}, sent); diff != "" {
+		t.Errorf("sent mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"two", "three"}, unsent); diff != "" {
+		t.Errorf("unsent mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMainCommandByArgsQueue(t *testing.T) {
+	script := `echo {} >> "$1/runs"; [ {} != fail ]`
+
+	queueFiles := func(t *testing.T, queueDir string) map[string][]string {
+		t.Helper()
+		files := make(map[string][]string)
+		for _, dir := range []string{"pending", "running", "done", "failed"} {
+			entries, err := os.ReadDir(filepath.Join(queueDir, dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				bs, err := os.ReadFile(filepath.Join(queueDir, dir, entry.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, string(bs))
+			}
+			slices.Sort(lines)
+			files[dir] = lines
+		}
+		return files
+	}
+
+	runs := func(t *testing.T, tmpDir string) []string {
+		t.Helper()
+		bs, err := os.ReadFile(filepath.Join(tmpDir, "runs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(string(bs))
+		slices.Sort(lines)
+		return lines
+	}
+
+	t.Run("runners share the queue", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		queueDir := filepath.Join(tmpDir, "queue")
+		args := []string{"-queue", queueDir, "-queue-poll", "10ms", "-p", "2", "sh", "-c", script, "sh", tmpDir}
+
+		var wg sync.WaitGroup
+		exitStatuses := make([]int, 2)
+		for i := range exitStatuses {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				spy := cli.SpyProcInout("a\nb\nc\nd\ne\nf\nfail\n")
+				exitStatuses[i] = MainCommandByArgs(args, spy.NewProcInout())
+			}()
+		}
+		wg.Wait()
+
+		if !slices.Contains(exitStatuses, 1) {
+			t.Errorf("expected a runner to report the failed job, got exit statuses %v", exitStatuses)
+		}
+		if diff := cmp.Diff([]string{"a", "b", "c", "d", "e", "f", "fail"}, runs(t, tmpDir)); diff != "" {
+			t.Errorf("runs mismatch (-want +got):\n%s", diff)
+		}
+		expected := map[string][]string{
+			"pending": {},
+			"running": {},
+			"done":    {"a", "b", "c", "d", "e", "f"},
+			"failed":  {"fail"},
+		}
+		if diff := cmp.Diff(expected, queueFiles(t, queueDir)); diff != "" {
+			t.Errorf("queue mismatch (-want +got):\n%s", diff)
+		}
+
+		spy := cli.SpyProcInout("a\ng\n")
+		if exitStatus := MainCommandByArgs(args, spy.NewProcInout()); exitStatus != 0 {
+			t.Errorf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+		}
+		if diff := cmp.Diff([]string{"a", "b", "c", "d", "e", "f", "fail", "g"}, runs(t, tmpDir)); diff != "" {
+			t.Errorf("runs mismatch after adding (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("expired jobs are reclaimed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		queueDir := filepath.Join(tmpDir, "queue")
+		for _, dir := range []string{"running", "done"} {
+			if err := os.MkdirAll(filepath.Join(queueDir, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for line, age := range map[string]time.Duration{"crashed": time.Hour, "alive": 0} {
+			path := filepath.Join(queueDir, "running", QueueName(line))
+			if err := os.WriteFile(path, []byte(line), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(-age)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The alive job is finished by its runner while this runner polls.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			_ = os.Rename(filepath.Join(queueDir, "running", QueueName("alive")), filepath.Join(queueDir, "done", QueueName("alive")))
+		}()
+
+		spy := cli.SpyProcInout()
+		args := []string{"-queue", queueDir, "-queue-worker", "-queue-lease", "1m", "-queue-poll", "10ms", "sh", "-c", script, "sh", tmpDir}
+		if exitStatus := MainCommandByArgs(args, spy.NewProcInout()); exitStatus != 0 {
+			t.Errorf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+		}
+		if diff := cmp.Diff([]string{"crashed"}, runs(t, tmpDir)); diff != "" {
+			t.Errorf("runs mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"alive", "crashed"}, queueFiles(t, queueDir)["done"]); diff != "" {
+			t.Errorf("done mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMainCommandByArgsEvents(t *testing.T) {
+	testCases := map[string]struct {
+		script        string
+		args          []string
+		expectedTypes []EventType
+	}{
+		"retried": {
+			script:        `echo out-{}; [ -e "$1/tried" ] || { touch "$1/tried"; exit 1; }`,
+			args:          []string{"-r", "1", "-retry-delay", "10ms"},
+			expectedTypes: []EventType{EventQueued, EventStarted, EventStdout, EventExited, EventRetried, EventStarted, EventStdout, EventExited},
+		},
+		"timed out": {
+			script:        `echo err-{} >&2; exec sleep 5`,
+			args:          []string{"-t", "100ms"},
+			expectedTypes: []EventType{EventQueued, EventStarted, EventStderr, EventTimedOut},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			eventsPath := filepath.Join(tmpDir, "events.jsonl")
+			args := append([]string{"-events", eventsPath}, tc.args...)
+			args = append(args, "sh", "-c", tc.script, "sh", tmpDir)
+			spy := cli.SpyProcInout("one\n")
+			MainCommandByArgs(args, spy.NewProcInout())
+
+			f, err := os.Open(eventsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var types []EventType
+			var events []Event
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var event Event
+				if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+					t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+				}
+				types = append(types, event.Type)
+				events = append(events, event)
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.expectedTypes, types); diff != "" {
+				t.Fatalf("event types mismatch (-want +got):\n%s", diff)
+			}
+			for _, event := range events {
+				if event.Seq != 1 || event.Input != "one" || event.Time.IsZero() {
+					t.Errorf("expected the event to have the job and the time, got %#v", event)
+				}
+				if event.Type == EventQueued {
+					continue
+				}
+				if event.Slot != 1 || event.Attempt == 0 {
+					t.Errorf("expected the event to have the slot and the attempt, got %#v", event)
+				}
+				if event.Type != EventRetried && event.PID == 0 {
+					t.Errorf("expected the event to have the PID, got %#v", event)
+				}
+				if (event.Type == EventExited || event.Type == EventTimedOut) && (event.ExitCode == nil || event.Start.IsZero()) {
+					t.Errorf("expected the ended event to have the exit code and the start, got %#v", event)
+				}
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsTrace(t *testing.T) {
+	tmpDir := t.TempDir()
+	tracePath := filepath.Join(tmpDir, "trace.json")
+	script := `[ {} != b ] || [ -e "$1/tried" ] || { touch "$1/tried"; exit 1; }`
+	spy := cli.SpyProcInout("a\nb\nc\n")
+	exitStatus := MainCommandByArgs([]string{"-p", "2", "-r", "1", "-retry-delay", "10ms", "-trace", tracePath, "sh", "-c", script, "sh", tmpDir}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+	}
+
+	bs, err := os.ReadFile(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []TraceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(bs, &trace); err != nil {
+		t.Fatal(err)
+	}
+
+	var tracks []string
+	var spans []string
+	for _, event := range trace.TraceEvents {
+		switch event.Ph {
+		case "M":
+			if event.Name == "thread_name" {
+				tracks = append(tracks, fmt.Sprintf("%d:%s", event.TID, event.Args["name"]))
+			}
+		case "X":
+			if event.TID < 1 || event.TID > 2 || event.Ts < 0 || event.Dur <= 0 {
+				t.Errorf("expected the span to be on a slot after the start, got %#v", event)
+			}
+			spans = append(spans, fmt.Sprintf("%s:%s:%v", event.Name, event.Cat, event.Args["attempt"]))
+		default:
+			t.Errorf("unexpected phase: %#v", event)
+		}
+	}
+	slices.Sort(spans)
+
+	if diff := cmp.Diff([]string{"1:slot 1", "2:slot 2"}, tracks); diff != "" {
+		t.Errorf("tracks mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"a:attempt:1", "b:attempt:1", "b:retry:2", "c:attempt:1"}, spans); diff != "" {
+		t.Errorf("spans mismatch (-want +got):\n%s", diff)
+	}
+}
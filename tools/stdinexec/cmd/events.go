@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	// EventQueued is emitted when a job is passed to the workers.
+	EventQueued EventType = "queued"
+	// EventStarted is emitted when an attempt starts the command or replays the cached result.
+	EventStarted EventType = "started"
+	// EventStdout is emitted for each chunk of the stdout of the command.
+	EventStdout EventType = "stdout"
+	// EventStderr is emitted for each chunk of the stderr of the command.
+	EventStderr EventType = "stderr"
+	// EventRetried is emitted when a failed attempt is going to be retried after the delay.
+	EventRetried EventType = "retried"
+	// EventExited is emitted when an attempt ends for a reason other than the timeout.
+	EventExited EventType = "exited"
+	// EventTimedOut is emitted when an attempt is terminated by the timeout.
+	EventTimedOut EventType = "timed_out"
+)
+
+// Event is a line of the event stream in JSON Lines.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	Seq  int       `json:"seq"`
+	// Input is the input line of the job.
+	Input string `json:"input"`
+	// Slot is the 1-origin worker slot, or zero for queued events.
+	Slot int `json:"slot,omitzero"`
+	// Attempt is the 1-origin number of the attempt.
+	Attempt int `json:"attempt,omitzero"`
+	// PID is the process ID of the command, or zero if not started.
+	PID int `json:"pid,omitzero"`
+	// Data is the chunk of the output. Invalid UTF-8 bytes are replaced with U+FFFD.
+	Data string `json:"data,omitzero"`
+	// Start is when the attempt started, for exited and timed out events.
+	Start time.Time `json:"start,omitzero"`
+	// Duration is the duration of the attempt in seconds, for exited and timed out events.
+	Duration float64 `json:"duration,omitzero"`
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Signal   string  `json:"signal,omitzero"`
+	Failure  string  `json:"failure,omitzero"`
+	Error    string  `json:"error,omitzero"`
+	// Delay is the delay before the next attempt in seconds, for retried events.
+	Delay  float64 `json:"delay,omitzero"`
+	Cached bool    `json:"cached,omitzero"`
+}
+
+// EventLog writes the events in JSON Lines. Nil means no events are written.
+type EventLog struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	now func() time.Time
+	// err is the first error on writing, which is returned by Close so that the workers need not handle it.
+	err    error
+	closed bool
+}
+
+func NewEventLog(w io.WriteCloser, now func() time.Time) *EventLog {
+	return &EventLog{w: w, now: now}
+}
+
+// Emit writes the event with the current time.
+func (l *EventLog) Emit(event Event) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil || l.closed {
+		return
+	}
+
+	event.Time = l.now()
+	bs, err := json.Marshal(event)
+	if err != nil {
+		l.err = fmt.Errorf("EventLog.Emit: failed to marshal event: %w", err)
+		return
+	}
+	bs = append(bs, '\n')
+	if _, err := l.w.Write(bs); err != nil {
+		l.err = fmt.Errorf("EventLog.Emit: failed to write event: %w", err)
+	}
+}
+
+// Close closes the writer, and returns the first error on writing if any. Closing again does nothing but returns it.
+func (l *EventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return l.err
+	}
+	l.closed = true
+	if err := l.w.Close(); err != nil && l.err == nil {
+		l.err = fmt.Errorf("EventLog.Close: %w", err)
+	}
+	return l.err
+}
+
+// openEvents opens the file at options.Events, or the file descriptor options.EventsFD to write the events to.
+func openEvents(options *Options) (io.WriteCloser, error) {
+	if options.EventsFD != 0 {
+		f := os.NewFile(uintptr(options.EventsFD), fmt.Sprintf("fd %d", options.EventsFD))
+		if f == nil {
+			return nil, fmt.Errorf("openEvents: invalid file descriptor: %d", options.EventsFD)
+		}
+		return f, nil
+	}
+	w, err := options.OpenFileFunc(options.Events, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("openEvents: %w", err)
+	}
+	return w, nil
+}
+
+// Job returns the JobEvents of the job running in the slot.
+func (l *EventLog) Job(job Job, slot int) *JobEvents {
+	return &JobEvents{log: l, Seq: job.Seq, Input: job.Line, Slot: slot}
+}
+
+// JobEvents emits the events of a job with its fields.
+type JobEvents struct {
+	log     *EventLog
+	Seq     int
+	Input   string
+	Slot    int
+	Attempt int
+	// PID is the process ID of the current attempt, or zero if not started.
+	PID int
+}
+
+// Emit writes the event with the fields of the job.
+func (e *JobEvents) Emit(event Event) {
+	event.Seq = e.Seq
+	event.Input = e.Input
+	event.Slot = e.Slot
+	event.Attempt = e.Attempt
+	event.PID = e.PID
+	e.log.Emit(event)
+}
+
+// Ended emits the exited or timed out event of the attempt.
+func (e *JobEvents) Ended(attempt Attempt) {
+	event := Event{
+		Type:     EventExited,
+		Start:    attempt.Start,
+		Duration: attempt.Duration.Seconds(),
+		ExitCode: &attempt.ExitCode,
+		Signal:   attempt.Signal,
+		Failure:  string(attempt.Kind),
+		Cached:   attempt.Cached,
+	}
+	if attempt.Kind == FailureTimedOut {
+		event.Type = EventTimedOut
+	}
+	if attempt.Err != nil {
+		event.Error = attempt.Err.Error()
+	}
+	e.Emit(event)
+}
+
+// Reader returns the reader that emits the chunks read from r as the events of the type.
+func (e *JobEvents) Reader(eventType EventType, r io.Reader) io.Reader {
+	if e.log == nil {
+		return r
+	}
+	return &eventReader{r: r, events: e, eventType: eventType}
+}
+
+type eventReader struct {
+	r         io.Reader
+	events    *JobEvents
+	eventType EventType
+}
+
+func (r *eventReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.events.Emit(Event{Type: r.eventType, Data: string(p[:n])})
+	}
+	return n, err
+}
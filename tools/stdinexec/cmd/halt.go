@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// HaltWhen is what to do with the running jobs when the halt policy is met.
+type HaltWhen string
+
+const (
+	// HaltNever never halts.
+	HaltNever HaltWhen = "never"
+	// HaltSoon stops starting new jobs and waits for the running jobs to finish.
+	HaltSoon HaltWhen = "soon"
+	// HaltNow stops starting new jobs and kills the running jobs.
+	HaltNow HaltWhen = "now"
+)
+
+// minJobsForHaltPercent is the minimum number of finished jobs to evaluate the failure percentage.
+const minJobsForHaltPercent = 3
+
+// HaltPolicy is when to halt the run like --halt of GNU parallel.
+type HaltPolicy struct {
+	When HaltWhen
+	// Failures is the number of failed jobs to halt at. Zero means Percent is used instead.
+	Failures int
+	// Percent is the percentage of failed jobs in finished jobs to halt at.
+	Percent float64
+}
+
+// NoHalt is the policy that never halts.
+var NoHalt = HaltPolicy{When: HaltNever}
+
+// ParseHaltPolicy parses a halt policy such as "never", "soon,fail=3" or "now,fail=10%".
+func ParseHaltPolicy(s string) (HaltPolicy, error) {
+	if s == string(HaltNever) {
+		return NoHalt, nil
+	}
+
+	whenRaw, condition, ok := strings.Cut(s, ",")
+	if !ok {
+		return HaltPolicy{}, fmt.Errorf("ParseHaltPolicy: condition is required: %q", s)
+	}
+
+	when := HaltWhen(whenRaw)
+	if when != HaltSoon && when != HaltNow {
+		return HaltPolicy{}, fmt.Errorf("ParseHaltPolicy: must start with never, soon or now: %q", s)
+	}
+
+	thresholdRaw, ok := strings.CutPrefix(condition, "fail=")
+	if !ok {
+		return HaltPolicy{}, fmt.Errorf("ParseHaltPolicy: condition must be fail=<n> or fail=<n>%%: %q", s)
+	}
+
+	if percentRaw, ok := strings.CutSuffix(thresholdRaw, "%"); ok {
+		percent, err := strconv.ParseFloat(percentRaw, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return HaltPolicy{}, fmt.Errorf("ParseHaltPolicy: percentage must be in (0, 100]: %q", s)
+		}
+		return HaltPolicy{When: when, Percent: percent}, nil
+	}
+
+	failures, err := strconv.Atoi(thresholdRaw)
+	if err != nil || failures < 1 {
+		return HaltPolicy{}, fmt.Errorf("ParseHaltPolicy: number of failures must be a positive integer: %q", s)
+	}
+	return HaltPolicy{When: when, Failures: failures}, nil
+}
+
+// Met returns whether the run should halt after finished jobs of which failed jobs failed.
+func (p HaltPolicy) Met(finished, failed int) bool {
+	switch p.When {
+	case HaltNever:
+		return false
+	case HaltSoon, HaltNow:
+	default:
+		panic(fmt.Sprintf("unknown halt policy: %q", p.When))
+	}
+
+	if p.Failures > 0 {
+		return failed >= p.Failures
+	}
+	if finished < minJobsForHaltPercent {
+		return false
+	}
+	return float64(failed)*100 >= p.Percent*float64(finished)
+}
+
+// String returns the halt policy in the syntax of ParseHaltPolicy.
+func (p HaltPolicy) String() string {
+	if p.When == HaltNever {
+		return string(HaltNever)
+	}
+	if p.Failures > 0 {
+		return fmt.Sprintf("%s,fail=%d", p.When, p.Failures)
+	}
+	return fmt.Sprintf("%s,fail=%s%%", p.When, strconv.FormatFloat(p.Percent, 'f', -1, 64))
+}
+
+// Halter halts the run when the halt policy is met or a signal is received.
+type Halter struct {
+	Policy HaltPolicy
+	// Dispatch is canceled when no more jobs should be started.
+	Dispatch context.Context
+	// Jobs is canceled when the running jobs should be killed.
+	Jobs context.Context
+	// Attempts is canceled when no more attempts including retries should be started.
+	Attempts     context.Context
+	stopDispatch context.CancelFunc
+	killJobs     context.CancelFunc
+	stopAttempts context.CancelFunc
+	halted       atomic.Bool
+
+	mu sync.Mutex
+	// running is the running commands to forward signals to.
+	running     map[*exec.Cmd]struct{}
+	interrupted os.Signal
+	killed      bool
+}
+
+// NewHalter returns a Halter whose contexts are derived from ctx.
+func NewHalter(ctx context.Context, policy HaltPolicy) *Halter {
+	dispatch, stopDispatch := context.WithCancel(ctx)
+	jobs, killJobs := context.WithCancel(ctx)
+	attempts, stopAttempts := context.WithCancel(jobs)
+	return &Halter{
+		Policy:       policy,
+		Dispatch:     dispatch,
+		Jobs:         jobs,
+		Attempts:     attempts,
+		stopDispatch: stopDispatch,
+		killJobs:     killJobs,
+		stopAttempts: stopAttempts,
+		running:      make(map[*exec.Cmd]struct{}),
+	}
+}
+
+// Observe halts the run if the halt policy is met. It returns whether the run is halted by this call.
+func (h *Halter) Observe(finished, failed int) bool {
+	if !h.Policy.Met(finished, failed) || !h.halted.CompareAndSwap(false, true) {
+		return false
+	}
+	h.stopDispatch()
+	if h.Policy.When == HaltNow {
+		h.killJobs()
+	}
+	return true
+}
+
+// Halted returns whether the run is halted by the halt policy.
+func (h *Halter) Halted() bool {
+	return h.halted.Load()
+}
+
+// Close releases the resources of the contexts.
+func (h *Halter) Close() {
+	h.stopDispatch()
+	h.killJobs()
+	h.stopAttempts()
+}
@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Kuniwak/ai-cli-tools/testableio"
+	"golang.org/x/sync/errgroup"
+)
+
+type FailureKind string
+
+const (
+	FailureNone     FailureKind = ""
+	FailureExited   FailureKind = "exited"
+	FailureTimedOut FailureKind = "timed out"
+	FailureError    FailureKind = "error"
+	FailureCanceled FailureKind = "canceled"
+	// FailurePostCondition is the kind of the attempts that exited successfully but did not write the expected output.
+	FailurePostCondition FailureKind = "post-condition failed"
+)
+
+// Attempt is the result of running a command once.
+type Attempt struct {
+	Start    time.Time
+	Duration time.Duration
+	// ExitCode is -1 if the command could not be started, was killed by a signal, or its output could not be read.
+	ExitCode int
+	// Signal is the name of the signal that killed the command, or empty if not killed by a signal.
+	Signal string
+	Stderr []byte
+	Kind   FailureKind
+	Err    error
+	// Cached is true if the result was replayed from the cache instead of running the command.
+	Cached bool
+	// NotStarted is true if the command was not started, such as when its input could not be opened or it was canceled
+	// before starting.
+	NotStarted bool
+}
+
+// maxStderrCapture is the maximum number of bytes of the stderr kept to classify failures.
+const maxStderrCapture = 64 * 1024
+
+// runAttempt runs the command once. If outputPath is not empty, the stdout of the command is written to the file
+// atomically, and the file is left untouched if the attempt fails. The attempt is checked by the post-condition at
+// expectPath, and its result is stored to the cache at cacheKey if not empty and the result is final.
+func runAttempt(run *Run, i int, job Job, commandAndArgs []string, outputPath string, expectPath string, cacheKey string, out *JobOutput, events *JobEvents) Attempt {
+	var recording *Recording
+	if cacheKey != "" {
+		recording = &Recording{}
+	}
+
+	start := time.Now()
+	attempt := runAttemptWithStdin(run, i, job, commandAndArgs, outputPath, recording, out, events)
+	attempt.Start = start
+	attempt.Duration = time.Since(start)
+	attempt = run.Options.PostCondition.Check(attempt, expectPath)
+
+	if recording != nil && run.cacheable(attempt) {
+		if err := run.Cache.Store(cacheKey, attempt.ExitCode, recording); err != nil {
+			run.Output.Stderrf("Cache: %s\n", err)
+		}
+	}
+	return attempt
+}
+
+func runAttemptWithStdin(run *Run, i int, job Job, commandAndArgs []string, outputPath string, recording *Recording, out *JobOutput, events *JobEvents) Attempt {
+	options := run.Options
+	var stdin io.Reader
+	switch options.Stdin {
+	case StdinNone:
+	case StdinFile:
+		f, err := os.Open(job.Line)
+		if err != nil {
+			return Attempt{ExitCode: -1, Kind: FailureError, Err: fmt.Errorf("runAttempt: failed to open input file: %w", err), NotStarted: true}
+		}
+		defer f.Close()
+		stdin = f
+	case StdinLine:
+		stdin = strings.NewReader(job.Line)
+	default:
+		panic(fmt.Sprintf("unknown stdin mode: %q", options.Stdin))
+	}
+
+	return runToOutput(outputPath, options, func(stdout io.Writer) Attempt {
+		return runCommand(run.Halter, i, commandAndArgs, stdin, stdout, recording, options, out, events)
+	})
+}
+
+// runToOutput runs execute with the stdout to write to. If outputPath is empty, the stdout is nil, otherwise it is the
+// file at outputPath written atomically only if the attempt succeeds. Missing parent directories of the file are created.
+func runToOutput(outputPath string, options *Options, execute func(stdout io.Writer) Attempt) Attempt {
+	if outputPath == "" {
+		return execute(nil)
+	}
+
+	if err := options.MkdirAllFunc(filepath.Dir(outputPath), 0755); err != nil {
+		return Attempt{ExitCode: -1, Kind: FailureError, Err: fmt.Errorf("runToOutput: %w", err), NotStarted: true}
+	}
+
+	f, err := testableio.CreateAtomicFile(outputPath, options.OpenFileFunc, options.RenameFunc, options.RemoveFunc)
+	if err != nil {
+		return Attempt{ExitCode: -1, Kind: FailureError, Err: fmt.Errorf("runToOutput: %w", err), NotStarted: true}
+	}
+
+	attempt := execute(f)
+	if attempt.Err != nil {
+		_ = f.Abort()
+		return attempt
+	}
+
+	if err := f.Commit(); err != nil {
+		attempt.Kind = FailureError
+		attempt.Err = fmt.Errorf("runToOutput: %w", err)
+	}
+	return attempt
+}
+
+// runCommand runs the command once. The stdin of the command is connected to stdin if not nil, and the stdout of the
+// command is written to stdout if not nil, or to out otherwise. The stdout and stderr are also recorded to recording if
+// not nil, and emitted to events with the started event. The command runs in its own process group, which is
+// terminated when the jobs of halter are killed or the timeout expires, and receives the signals forwarded by halter.
+func runCommand(halter *Halter, i int, commandAndArgs []string, stdin io.Reader, stdout io.Writer, recording *Recording, options *Options, out *JobOutput, events *JobEvents) Attempt {
+	ctx := halter.Jobs
+	if err := ctx.Err(); err != nil {
+		return Attempt{ExitCode: -1, Kind: FailureCanceled, Err: fmt.Errorf("runAttempt: %w", err), NotStarted: true}
+	}
+	if sig := halter.Interrupted(); sig != nil {
+		return Attempt{ExitCode: -1, Kind: FailureCanceled, Err: fmt.Errorf("runAttempt: interrupted by %s", sig), NotStarted: true}
+	}
+
+	cmd := exec.Command(commandAndArgs[0], commandAndArgs[1:]...)
+	cmd.Stdin = stdin
+	setProcessGroup(cmd)
+
+	stdoutPipe, _ := cmd.StdoutPipe()
+	stderrPipe, _ := cmd.StderrPipe()
+	var stdoutReader, stderrReader io.Reader = stdoutPipe, stderrPipe
+	if recording != nil {
+		stdoutReader = io.TeeReader(stdoutPipe, &recording.Stdout)
+		stderrReader = io.TeeReader(stderrPipe, &recording.Stderr)
+	}
+	stdoutReader = events.Reader(EventStdout, stdoutReader)
+	stderrReader = events.Reader(EventStderr, stderrReader)
+
+	if err := cmd.Start(); err != nil {
+		return Attempt{ExitCode: -1, Kind: FailureError, Err: fmt.Errorf("runAttempt: failed to execute command: %w (%d %#v)", err, i, commandAndArgs), NotStarted: true}
+	}
+	untrack := halter.track(cmd)
+	defer untrack()
+	events.PID = cmd.Process.Pid
+	events.Emit(Event{Type: EventStarted})
+
+	attemptCtx := ctx
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	var timedOut, canceled atomic.Bool
+	exited := make(chan struct{})
+	stop := context.AfterFunc(attemptCtx, func() {
+		select {
+		case <-exited:
+			return
+		default:
+		}
+		if ctx.Err() != nil {
+			canceled.Store(true)
+		} else {
+			timedOut.Store(true)
+		}
+		_ = signalProcessGroup(cmd, syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(options.KillGrace):
+			_ = signalProcessGroup(cmd, syscall.SIGKILL)
+		}
+	})
+	defer stop()
+
+	stderr := &bytes.Buffer{}
+	var eg errgroup.Group
+	eg.Go(func() error {
+		if stdout != nil {
+			if _, err := io.Copy(stdout, stdoutReader); err != nil {
+				return fmt.Errorf("runAttempt: failed to copy stdout: %w", err)
+			}
+			return nil
+		}
+
+		scanner := bufio.NewScanner(stdoutReader)
+		scanner.Split(bufio.ScanLines)
+		for scanner.Scan() {
+			out.StdoutLine(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("runAttempt: failed to scan stdout: %w", err)
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		scanner := bufio.NewScanner(stderrReader)
+		scanner.Split(bufio.ScanLines)
+		for scanner.Scan() {
+			text := scanner.Text()
+			if stderr.Len() < maxStderrCapture {
+				stderr.WriteString(text)
+				stderr.WriteString("\n")
+			}
+			out.StderrLine(text)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("runAttempt: failed to scan stderr: %w", err)
+		}
+		return nil
+	})
+
+	if err := eg.Wait(); err != nil {
+		_ = cmd.Wait()
+		close(exited)
+		return Attempt{ExitCode: -1, Stderr: stderr.Bytes(), Kind: FailureError, Err: fmt.Errorf("runAttempt: failed to wait for stdout and stderr to complete: %w", err)}
+	}
+
+	err := cmd.Wait()
+	close(exited)
+	signal := signalName(cmd.ProcessState)
+	if canceled.Load() {
+		return Attempt{ExitCode: cmd.ProcessState.ExitCode(), Signal: signal, Stderr: stderr.Bytes(), Kind: FailureCanceled, Err: fmt.Errorf("runAttempt: command canceled: %w (%d %#v)", context.Cause(ctx), i, commandAndArgs)}
+	}
+	if sig := halter.Interrupted(); sig != nil && err != nil {
+		return Attempt{ExitCode: cmd.ProcessState.ExitCode(), Signal: signal, Stderr: stderr.Bytes(), Kind: FailureCanceled, Err: fmt.Errorf("runAttempt: command interrupted by %s: %w (%d %#v)", sig, err, i, commandAndArgs)}
+	}
+	if timedOut.Load() {
+		return Attempt{ExitCode: cmd.ProcessState.ExitCode(), Signal: signal, Stderr: stderr.Bytes(), Kind: FailureTimedOut, Err: fmt.Errorf("runAttempt: command timed out after %s (%d %#v)", options.Timeout, i, commandAndArgs)}
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return Attempt{ExitCode: -1, Stderr: stderr.Bytes(), Kind: FailureError, Err: fmt.Errorf("runAttempt: failed to wait for command to complete: %w (%d %#v)", err, i, commandAndArgs)}
+		}
+		return Attempt{ExitCode: exitErr.ExitCode(), Signal: signal, Stderr: stderr.Bytes(), Kind: FailureExited, Err: fmt.Errorf("runAttempt: failed to wait for command to complete: %w (%d %#v)", err, i, commandAndArgs)}
+	}
+	return Attempt{ExitCode: 0, Stderr: stderr.Bytes(), Kind: FailureNone}
+}
+
+func signalName(state *os.ProcessState) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	return status.Signal().String()
+}
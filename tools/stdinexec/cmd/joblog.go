@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// JobLogRecord is a line of the job log in JSON Lines.
+type JobLogRecord struct {
+	Seq      int       `json:"seq"`
+	Input    string    `json:"input"`
+	Attempts int       `json:"attempts"`
+	Start    time.Time `json:"start"`
+	// Duration is the duration of all attempts in seconds.
+	Duration   float64 `json:"duration"`
+	ExitStatus int     `json:"exit_status"`
+	Signal     string  `json:"signal,omitempty"`
+	Failure    string  `json:"failure,omitempty"`
+	Skipped    bool    `json:"skipped,omitempty"`
+	Cached     bool    `json:"cached,omitempty"`
+}
+
+func (r JobLogRecord) Succeeded() bool {
+	return r.Failure == ""
+}
+
+func NewJobLogRecord(result JobResult) JobLogRecord {
+	return JobLogRecord{
+		Seq:        result.Seq,
+		Input:      result.Line,
+		Attempts:   result.Attempts,
+		Start:      result.Start,
+		Duration:   result.Duration.Seconds(),
+		ExitStatus: result.ExitCode,
+		Signal:     result.Signal,
+		Failure:    string(result.Kind),
+		Skipped:    result.Skipped,
+		Cached:     result.Cached,
+	}
+}
+
+type JobLog struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	closed bool
+}
+
+func NewJobLog(w io.WriteCloser) *JobLog {
+	return &JobLog{w: w}
+}
+
+func (l *JobLog) Write(result JobResult) error {
+	bs, err := json.Marshal(NewJobLogRecord(result))
+	if err != nil {
+		return fmt.Errorf("JobLog.Write: failed to marshal record: %w", err)
+	}
+	bs = append(bs, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(bs); err != nil {
+		return fmt.Errorf("JobLog.Write: failed to write record: %w", err)
+	}
+	return nil
+}
+
+// Close closes the writer. Closing nil or again does nothing.
+func (l *JobLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if err := l.w.Close(); err != nil {
+		return fmt.Errorf("JobLog.Close: %w", err)
+	}
+	return nil
+}
+
+// ReadSucceededInputs returns the inputs that succeeded in the job log at the path.
+// It returns an empty set if the job log does not exist.
+func ReadSucceededInputs(path string) (map[string]struct{}, error) {
+	succeeded := make(map[string]struct{})
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return succeeded, nil
+		}
+		return nil, fmt.Errorf("ReadSucceededInputs: failed to open job log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record JobLogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// The last record may be truncated if the previous run crashed.
+			continue
+		}
+		if record.Succeeded() {
+			succeeded[record.Input] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadSucceededInputs: failed to scan job log: %w", err)
+	}
+	return succeeded, nil
+}
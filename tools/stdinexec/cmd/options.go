@@ -5,26 +5,106 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/outputcheck"
+	"github.com/Kuniwak/ai-cli-tools/testableio"
 	"github.com/Kuniwak/ai-cli-tools/tools"
 )
 
+type StdinMode string
+
+const (
+	StdinNone StdinMode = "none"
+	StdinFile StdinMode = "file"
+	StdinLine StdinMode = "line"
+)
+
 type Options struct {
 	CommonOptions  tools.CommonOptions
 	Reader         io.Reader
 	CommandAndArgs []string
 	Null           bool
 	Parallel       int
+	RetryPolicy    RetryPolicy
+	// Timeout is the maximum duration of each attempt. Zero means no timeout.
+	Timeout   time.Duration
+	KillGrace time.Duration
+	// Stdin is what is connected to the stdin of the command.
+	Stdin StdinMode
+	// Group buffers the output of each job and writes it at once when the job finishes.
+	Group bool
+	// Tag prefixes each output line with the input line instead of the worker index.
+	Tag bool
+	// OutputTemplate is the path of the file to write the stdout of each job to, or empty to write to the stdout.
+	OutputTemplate string
+	// Force overwrites existing output files instead of skipping the jobs.
+	Force        bool
+	OpenFileFunc testableio.OpenFileFunc
+	RenameFunc   testableio.RenameFunc
+	RemoveFunc   testableio.RemoveFunc
+	MkdirAllFunc testableio.MkdirAllFunc
+	ExistsFunc   testableio.ExistsFunc
+	StatFunc     testableio.StatFunc
+	ReadFileFunc testableio.ReadFileFunc
+	ReadDirFunc  testableio.ReadDirFunc
+	// JobLog is the path of the job log, or empty if no job log is written.
+	JobLog string
+	// Resume skips the inputs that succeeded in the job log.
+	Resume bool
+	// Halt is when to stop starting new jobs and whether to kill the running jobs.
+	Halt HaltPolicy
+	// RateLimit is the maximum rate of attempts shared by all workers.
+	RateLimit RateLimit
+	// Burst is the number of attempts allowed to start at once under RateLimit.
+	Burst int
+	// Adaptive is how to adapt the number of concurrent attempts to rate limits up to Parallel.
+	Adaptive AdaptivePolicy
+	// PostCondition is what the output declared to the command must satisfy after the command succeeds.
+	PostCondition PostCondition
+	// Cache is how to cache the results of the commands.
+	Cache CacheOptions
+	// Queue is how to share the jobs with other runners.
+	Queue QueueOptions
+	// Events is the path to write the events in JSON Lines to, or empty if not written to a file.
+	Events string
+	// EventsFD is the file descriptor to write the events to, or zero if not written to a file descriptor.
+	EventsFD int
+	// Trace is the path to write the timeline of the run in the Chrome Trace Event Format to, or empty if not written.
+	Trace string
+	// SummaryJSON is the path to write the summary in JSON to, or empty if not written.
+	SummaryJSON string
+	// Progress writes the progress and the ETA to the stderr.
+	Progress bool
+	// ProgressInterval is the interval of progress lines if the stderr is not a terminal.
+	ProgressInterval time.Duration
+	// Strict refuses unsafe input lines if they are substituted into shell scripts without quoting.
+	Strict bool
 }
 
 func ParseOptions(args []string, inout *cli.ProcInout) (*Options, error) {
 	flags := flag.NewFlagSet("stdinexec", flag.ContinueOnError)
 	flags.SetOutput(inout.Stderr)
 	flags.Usage = func() {
-		fmt.Fprintf(inout.Stderr, `Usage: stdinexec [-0] [-p <parallel>] <command> [<args>...]
+		fmt.Fprintf(inout.Stderr, `Usage: stdinexec [<options>] <command> [<args>...]
+
+Execute a command for each line of the input, similar to "find -exec". The following replacement strings in arguments
+are replaced like GNU parallel:
+  {}    the line of the stdin
+  {.}   the line without extension
+  {/}   basename of the line
+  {//}  dirname of the line
+  {/.}  basename of the line without extension
+  {#}   sequence number of the line
+  {%%}   worker slot (1 to <parallel>)
+  {q}   the line quoted for POSIX shells
 
-Execute a command for each line of the input, similar to "find -exec". "{}" in arguments is replaced with the line of the stdin.
+Use {q} instead of "{}" in shell scripts such as "bash -c", or specify -s to refuse unsafe lines. See README.md for
+details of the options.
 
 Options:
 `)
@@ -33,7 +113,52 @@ Options:
 		fmt.Fprintf(inout.Stderr, `
 Examples:
   $ # Process ./input/*.md files in parallel using 3 processes by Claude Code.
-  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 bash -c 'claude -p < "{}"'
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 bash -c 'claude -p < {q}'
+
+  $ # Keep the output of each job together and tag it with the input file.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -g -tag bash -c 'claude -p < {q}'
+
+  $ # Write the result of each job to ./output/<name>.json. Inputs that already have outputs are skipped.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -o './output/{/.}.json' bash -c 'claude -p --output-format json < {q}'
+
+  $ # Resume the previous run. Only inputs that did not succeed are processed.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -joblog ./joblog.jsonl -resume bash -c 'claude -p < {q}'
+
+  $ # Terminate Claude Code if it hangs for 10 minutes.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -t 10m bash -c 'claude -p < {q}'
+
+  $ # Same as above without any shell.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -i file claude -p
+
+  $ # Render a prompt for each input TSV file into ./prompt and derive the output path inline.
+  $ find ./input -name '*.tsv' -print0 | stdinexec -0 -o './prompt/{/.}.md' stdinsubst -f ./prompt_template.md '%%INPUT_TSV%%' '{}' '%%OUTPUT%%' 'literal:./output/{/.}.json'
+
+  $ # Stop starting new jobs and kill the running jobs once 3 jobs failed, e.g. when the quota is exhausted.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -halt now,fail=3 bash -c 'claude -p < {q}'
+
+  $ # Run at most 5 Claude Code processes at once and start at most 50 per minute.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 5 -rate 50/m bash -c 'claude -p < {q}'
+
+  $ # Run up to 10 Claude Code processes, and reduce them while Claude Code hits rate limits.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 10 -r 5 -adaptive-stderr '(?i)rate limit|429' bash -c 'claude -p < {q}'
+
+  $ # Fail and retry the jobs if Claude Code does not write the result to the output path in the prompt.
+  $ find ./input -name '*.tsv' -print0 \
+      | stdinsubst -0 -f ./prompt_template.md -o ./prompt -t '{/.}.md' '%%INPUT_TSV%%' '{}' '%%OUTPUT%%' 'literal:./output/{/.}.json' \
+      | stdinexec -0 -p 3 -r 2 -i file -expect './output/{/.}.json' -expect-format json -expect-fresh claude -p
+
+  $ # Replay the results of the same prompts from the cache for a week instead of running Claude Code again.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -i file -cache ~/.cache/stdinexec -cache-ttl 168h -cache-max-size 1G claude -p
+
+  $ # Share the jobs with other machines through NFS. Run the second command on each of the other machines.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -queue ~/queue -i file claude -p
+  $ stdinexec -queue ~/queue -queue-worker -p 3 -i file claude -p
+
+  $ # Write the timeline of the run to open it in Perfetto.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -trace ./trace.json bash -c 'claude -p < {q}'
+
+  $ # Retry up to 5 times if Claude Code hits rate limits or overloaded errors.
+  $ find ./input -name '*.md' -print0 | stdinexec -0 -p 3 -r 5 -retry-stderr '(?i)rate limit|overloaded|429' bash -c 'claude -p < {q}'
 `)
 	}
 
@@ -43,6 +168,53 @@ Examples:
 	null := flags.Bool("0", false, "use null byte as the record separator")
 	parallelShort := flags.Int("p", 0, "number of parallel executions")
 	parallelLong := flags.Int("parallel", 0, "number of parallel executions")
+	stdinShort := flags.String("i", "", "connect the file at the line (file) or the line itself (line) to the stdin of the command")
+	stdinLong := flags.String("stdin", "", "connect the file at the line (file) or the line itself (line) to the stdin of the command")
+	groupShort := flags.Bool("g", false, "write the output of each job at once when the job finishes")
+	groupLong := flags.Bool("group", false, "write the output of each job at once when the job finishes")
+	strictShort := flags.Bool("s", false, "refuse unsafe lines substituted into \"-c\" scripts without {q}")
+	strictLong := flags.Bool("strict", false, "refuse unsafe lines substituted into \"-c\" scripts without {q}")
+	rate := flags.String("rate", "", "maximum rate of attempts such as 10/s, 50/m or 1000/h (default: no limit)")
+	burst := flags.Int("burst", 1, "number of attempts allowed to start at once under -rate")
+	adaptiveExitCodes := flags.String("adaptive-exit-codes", "", "comma-separated exit codes of rate-limited attempts (enables adaptive concurrency)")
+	adaptiveStderr := flags.String("adaptive-stderr", "", "regexp matched against the stderr of rate-limited attempts (enables adaptive concurrency)")
+	adaptiveCooldown := flags.Duration("adaptive-cooldown", 30*time.Second, "duration to pause starting attempts after a rate limit")
+	adaptiveIncreaseAfter := flags.Int("adaptive-increase-after", 10, "number of consecutive successes to add a worker back after")
+	expect := flags.String("expect", "", "path template of the output the command must write, checked after the command succeeds")
+	expectNonEmpty := flags.Bool("expect-non-empty", false, "require the expected output to be non-empty")
+	expectFormat := flags.String("expect-format", "", "require the expected output to be valid in the format: json or jsonl")
+	expectFresh := flags.Bool("expect-fresh", false, "require the expected output to be modified by the attempt")
+	cacheDir := flags.String("cache", "", "directory to cache the results of the commands in")
+	cacheEnv := flags.String("cache-env", "", "comma-separated names of environment variables included in the cache key")
+	cacheTTL := flags.Duration("cache-ttl", 0, "duration to replay cached results for (default: forever)")
+	cacheMaxSize := flags.String("cache-max-size", "", "maximum total size of the cache such as 512M or 1G (default: no limit)")
+	noCache := flags.Bool("no-cache", false, "run the commands without replaying cached results, and replace them")
+	queueDir := flags.String("queue", "", "directory of the work queue shared with other processes")
+	queueWorker := flags.Bool("queue-worker", false, "only run the jobs in the queue without adding the stdin to it")
+	queueLease := flags.Duration("queue-lease", 5*time.Minute, "duration after which running jobs of crashed processes are reclaimed")
+	queuePoll := flags.Duration("queue-poll", 5*time.Second, "interval to look for reclaimed jobs while other processes are running jobs")
+	events := flags.String("events", "", "path to write the events of the jobs in JSON Lines to")
+	eventsFD := flags.Int("events-fd", 0, "file descriptor to write the events of the jobs in JSON Lines to, such as 3")
+	trace := flags.String("trace", "", "path to write the timeline of the run in the Chrome Trace Event Format to")
+	summaryJSON := flags.String("summary-json", "", "path to write the summary of the run in JSON to")
+	progress := flags.Bool("progress", false, "write the progress and the ETA to the stderr")
+	progressInterval := flags.Duration("progress-interval", 10*time.Second, "interval of progress lines if the stderr is not a terminal")
+	tag := flags.Bool("tag", false, "prefix output lines with the input line instead of the worker index")
+	outputTemplateShort := flags.String("o", "", "path template of the file to write the stdout of each job to")
+	outputTemplateLong := flags.String("output", "", "path template of the file to write the stdout of each job to")
+	force := flags.Bool("force", false, "overwrite existing output files instead of skipping the jobs")
+	jobLog := flags.String("joblog", "", "path of the job log in JSON Lines")
+	resume := flags.Bool("resume", false, "skip inputs that succeeded in the job log")
+	timeoutShort := flags.Duration("t", 0, "timeout of each job (default: no timeout)")
+	timeoutLong := flags.Duration("timeout", 0, "timeout of each job (default: no timeout)")
+	killGrace := flags.Duration("kill-grace", 10*time.Second, "grace period between SIGTERM and SIGKILL on timeout or halt")
+	halt := flags.String("halt", string(HaltNever), "halt policy: never, soon,fail=<n>[%] or now,fail=<n>[%]")
+	retriesShort := flags.Int("r", 0, "number of retries of failed jobs")
+	retriesLong := flags.Int("retries", 0, "number of retries of failed jobs")
+	retryDelay := flags.Duration("retry-delay", time.Second, "base delay before retrying, doubled every attempt")
+	retryMaxDelay := flags.Duration("retry-max-delay", time.Minute, "maximum delay before retrying, or 0 for no maximum")
+	retryExitCodes := flags.String("retry-exit-codes", "", "comma-separated exit codes to retry")
+	retryStderr := flags.String("retry-stderr", "", "regexp matched against the stderr of failures to retry")
 
 	if err := flags.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
@@ -77,12 +249,244 @@ Examples:
 		return nil, fmt.Errorf("ParseOptions: command is required")
 	}
 
+	rateLimit, err := ParseRateLimit(*rate)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	if *burst < 1 {
+		return nil, fmt.Errorf("ParseOptions: burst must be at least 1")
+	}
+
+	adaptive, err := parseAdaptivePolicy(*adaptiveExitCodes, *adaptiveStderr, *adaptiveCooldown, *adaptiveIncreaseAfter)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	format, err := outputcheck.ParseFormat(*expectFormat)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	if *expect == "" && (*expectNonEmpty || *expectFresh || format != outputcheck.FormatAny) {
+		return nil, fmt.Errorf("ParseOptions: -expect-non-empty, -expect-format and -expect-fresh require -expect")
+	}
+
+	maxSize, err := ParseSize(*cacheMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid cache max size: %w", err)
+	}
+
+	if *cacheTTL < 0 {
+		return nil, fmt.Errorf("ParseOptions: cache TTL must not be negative")
+	}
+
+	if *cacheDir == "" && (*cacheEnv != "" || *cacheTTL != 0 || maxSize != 0) {
+		return nil, fmt.Errorf("ParseOptions: -cache-env, -cache-ttl and -cache-max-size require -cache")
+	}
+
+	var cacheEnvNames []string
+	if *cacheEnv != "" {
+		for _, name := range strings.Split(*cacheEnv, ",") {
+			cacheEnvNames = append(cacheEnvNames, strings.TrimSpace(name))
+		}
+	}
+
+	if *events != "" && *eventsFD != 0 {
+		return nil, fmt.Errorf("ParseOptions: -events and -events-fd are exclusive")
+	}
+
+	if *eventsFD < 0 {
+		return nil, fmt.Errorf("ParseOptions: events file descriptor must not be negative")
+	}
+
+	if *queueWorker && *queueDir == "" {
+		return nil, fmt.Errorf("ParseOptions: -queue-worker requires -queue")
+	}
+
+	if *queueLease <= 0 || *queuePoll <= 0 {
+		return nil, fmt.Errorf("ParseOptions: queue lease and poll interval must be positive")
+	}
+
+	if *progressInterval <= 0 {
+		return nil, fmt.Errorf("ParseOptions: progress interval must be positive")
+	}
+
+	haltPolicy, err := ParseHaltPolicy(*halt)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
 	commandAndArgs := flags.Args()
 
+	var retries int
+	if *retriesLong != 0 {
+		retries = *retriesLong
+	} else {
+		retries = *retriesShort
+	}
+
+	if retries < 0 {
+		return nil, fmt.Errorf("ParseOptions: retries must not be negative")
+	}
+
+	var stdinRaw string
+	if *stdinLong != "" {
+		stdinRaw = *stdinLong
+	} else {
+		stdinRaw = *stdinShort
+	}
+
+	var stdin StdinMode
+	switch StdinMode(stdinRaw) {
+	case "", StdinNone:
+		stdin = StdinNone
+	case StdinFile:
+		stdin = StdinFile
+	case StdinLine:
+		stdin = StdinLine
+	default:
+		return nil, fmt.Errorf("ParseOptions: stdin must be one of none, file or line: %q", stdinRaw)
+	}
+
+	var outputTemplate string
+	if *outputTemplateLong != "" {
+		outputTemplate = *outputTemplateLong
+	} else {
+		outputTemplate = *outputTemplateShort
+	}
+
+	if *resume && *jobLog == "" {
+		return nil, fmt.Errorf("ParseOptions: -resume requires -joblog")
+	}
+
+	var timeout time.Duration
+	if *timeoutLong != 0 {
+		timeout = *timeoutLong
+	} else {
+		timeout = *timeoutShort
+	}
+
+	if timeout < 0 {
+		return nil, fmt.Errorf("ParseOptions: timeout must not be negative")
+	}
+
+	exitCodes, err := parseExitCodes(*retryExitCodes)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid retry exit codes: %w", err)
+	}
+
+	var stderrPattern *regexp.Regexp
+	if *retryStderr != "" {
+		stderrPattern, err = regexp.Compile(*retryStderr)
+		if err != nil {
+			return nil, fmt.Errorf("ParseOptions: invalid retry stderr pattern: %w", err)
+		}
+	}
+
 	return &Options{
 		Reader:         inout.Stdin,
 		CommandAndArgs: commandAndArgs,
 		Null:           *null,
 		Parallel:       parallel,
+		RetryPolicy: RetryPolicy{
+			MaxAttempts:   retries + 1,
+			BaseDelay:     *retryDelay,
+			MaxDelay:      *retryMaxDelay,
+			ExitCodes:     exitCodes,
+			StderrPattern: stderrPattern,
+		},
+		Timeout:        timeout,
+		KillGrace:      *killGrace,
+		Stdin:          stdin,
+		Group:          *groupShort || *groupLong,
+		Tag:            *tag,
+		OutputTemplate: outputTemplate,
+		Force:          *force,
+		OpenFileFunc:   testableio.NewOpenFileFunc(),
+		RenameFunc:     testableio.NewRenameFunc(),
+		RemoveFunc:     testableio.NewRemoveFunc(),
+		MkdirAllFunc:   testableio.NewMkdirAllFunc(),
+		ExistsFunc:     testableio.NewExistsFunc(),
+		StatFunc:       testableio.NewStatFunc(),
+		ReadFileFunc:   testableio.NewReadFileFunc(),
+		ReadDirFunc:    testableio.NewReadDirFunc(),
+		JobLog:         *jobLog,
+		Resume:         *resume,
+		Halt:           haltPolicy,
+		RateLimit:      rateLimit,
+		Burst:          *burst,
+		Adaptive:       adaptive,
+		PostCondition: PostCondition{
+			PathTemplate: *expect,
+			Conditions:   outputcheck.Conditions{NonEmpty: *expectNonEmpty, Format: format},
+			Fresh:        *expectFresh,
+		},
+		Cache: CacheOptions{
+			Dir:     *cacheDir,
+			Env:     cacheEnvNames,
+			TTL:     *cacheTTL,
+			MaxSize: maxSize,
+			NoCache: *noCache,
+		},
+		Queue: QueueOptions{
+			Dir:    *queueDir,
+			Worker: *queueWorker,
+			Lease:  *queueLease,
+			Poll:   *queuePoll,
+		},
+		Events:           *events,
+		EventsFD:         *eventsFD,
+		Trace:            *trace,
+		SummaryJSON:      *summaryJSON,
+		Progress:         *progress,
+		ProgressInterval: *progressInterval,
+		Strict:           *strictShort || *strictLong,
+	}, nil
+}
+
+func parseExitCodes(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	exitCodes := make([]int, len(fields))
+	for i, field := range fields {
+		exitCode, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("parseExitCodes: %w", err)
+		}
+		exitCodes[i] = exitCode
+	}
+	return exitCodes, nil
+}
+
+func parseAdaptivePolicy(exitCodesRaw, stderrRaw string, cooldown time.Duration, increaseAfter int) (AdaptivePolicy, error) {
+	exitCodes, err := parseExitCodes(exitCodesRaw)
+	if err != nil {
+		return AdaptivePolicy{}, fmt.Errorf("parseAdaptivePolicy: invalid exit codes: %w", err)
+	}
+
+	var stderrPattern *regexp.Regexp
+	if stderrRaw != "" {
+		stderrPattern, err = regexp.Compile(stderrRaw)
+		if err != nil {
+			return AdaptivePolicy{}, fmt.Errorf("parseAdaptivePolicy: invalid stderr pattern: %w", err)
+		}
+	}
+
+	if cooldown < 0 {
+		return AdaptivePolicy{}, fmt.Errorf("parseAdaptivePolicy: cooldown must not be negative")
+	}
+
+	if increaseAfter < 1 {
+		return AdaptivePolicy{}, fmt.Errorf("parseAdaptivePolicy: number of successes to increase must be at least 1")
+	}
+
+	return AdaptivePolicy{
+		ExitCodes:     exitCodes,
+		StderrPattern: stderrPattern,
+		Cooldown:      cooldown,
+		IncreaseAfter: increaseAfter,
 	}, nil
 }
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+)
+
+// Output serializes writes from jobs running in parallel, so that lines are never mixed up.
+type Output struct {
+	mu     sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+	// status is the line redrawn at the bottom of the terminal, or empty if none.
+	status string
+}
+
+func NewOutput(inout *cli.ProcInout) *Output {
+	return &Output{stdout: inout.Stdout, stderr: inout.Stderr}
+}
+
+func (o *Output) Stderrf(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.clearStatus()
+	fmt.Fprintf(o.stderr, format, args...)
+	o.drawStatus()
+}
+
+func (o *Output) write(w io.Writer, bs []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.clearStatus()
+	w.Write(bs)
+	o.drawStatus()
+}
+
+// SetStatus redraws the status line at the bottom of the terminal. The status line is kept below the other output.
+// An empty line removes the status line.
+func (o *Output) SetStatus(line string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.clearStatus()
+	o.status = line
+	o.drawStatus()
+}
+
+func (o *Output) clearStatus() {
+	if o.status != "" {
+		io.WriteString(o.stderr, "\r\x1b[K")
+	}
+}
+
+func (o *Output) drawStatus() {
+	if o.status != "" {
+		io.WriteString(o.stderr, o.status)
+	}
+}
+
+// JobOutput writes the output lines of a job with the prefix. If grouped, the lines are buffered until Flush.
+type JobOutput struct {
+	out    *Output
+	prefix string
+	group  bool
+	mu     sync.Mutex
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (o *Output) NewJobOutput(prefix string, group bool) *JobOutput {
+	return &JobOutput{out: o, prefix: prefix, group: group}
+}
+
+func (j *JobOutput) StdoutLine(text string) {
+	j.writeLine(&j.stdout, j.out.stdout, text)
+}
+
+func (j *JobOutput) StderrLine(text string) {
+	j.writeLine(&j.stderr, j.out.stderr, text)
+}
+
+func (j *JobOutput) writeLine(buf *bytes.Buffer, w io.Writer, text string) {
+	line := make([]byte, 0, len(j.prefix)+len(text)+2)
+	if j.prefix != "" {
+		line = append(line, j.prefix...)
+		line = append(line, '\t')
+	}
+	line = append(line, text...)
+	line = append(line, '\n')
+
+	if j.group {
+		j.mu.Lock()
+		buf.Write(line)
+		j.mu.Unlock()
+		return
+	}
+	j.out.write(w, line)
+}
+
+// Flush writes the buffered lines at once. It does nothing if not grouped.
+func (j *JobOutput) Flush() {
+	if !j.group {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.out.mu.Lock()
+	defer j.out.mu.Unlock()
+	j.out.clearStatus()
+	j.out.stdout.Write(j.stdout.Bytes())
+	j.out.stderr.Write(j.stderr.Bytes())
+	j.out.drawStatus()
+	j.stdout.Reset()
+	j.stderr.Reset()
+}
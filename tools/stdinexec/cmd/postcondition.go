@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Kuniwak/ai-cli-tools/outputcheck"
+)
+
+// PostCondition is what the output declared to the command must satisfy after the command succeeds.
+type PostCondition struct {
+	// PathTemplate is the path template of the expected output, or empty if not checked.
+	PathTemplate string
+	Conditions   outputcheck.Conditions
+	// Fresh requires the expected output to be modified during the attempt.
+	Fresh bool
+}
+
+// Check marks the succeeded attempt failed if the expected output at path does not satisfy the post-condition.
+func (p PostCondition) Check(attempt Attempt, path string) Attempt {
+	if p.PathTemplate == "" || attempt.Err != nil {
+		return attempt
+	}
+
+	conditions := p.Conditions
+	// Cached results are not written by the attempt.
+	if p.Fresh && !attempt.Cached {
+		conditions.ModifiedSince = attempt.Start
+	}
+
+	if err := outputcheck.Check(path, "", conditions); err != nil {
+		if errors.Is(err, outputcheck.ErrNotSatisfied) {
+			attempt.Kind = FailurePostCondition
+		} else {
+			attempt.Kind = FailureError
+		}
+		attempt.Err = fmt.Errorf("PostCondition.Check: %w", err)
+	}
+	return attempt
+}
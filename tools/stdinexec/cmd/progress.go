@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationWindow is the number of recent job durations the ETA is estimated from.
+const durationWindow = 20
+
+// ttyRefreshInterval is the interval to redraw the progress line on a terminal.
+const ttyRefreshInterval = 200 * time.Millisecond
+
+// Progress counts the jobs to estimate the time to finish.
+type Progress struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	start    time.Time
+	parallel int
+	// queued is the number of jobs read from the stdin to run.
+	queued int
+	// inputEnded is true if the stdin is fully read and queued is the total.
+	inputEnded bool
+	running    int
+	done       int
+	failed     int
+	// durations is the ring buffer of the recent job durations.
+	durations []time.Duration
+	next      int
+}
+
+func NewProgress(parallel int, now func() time.Time) *Progress {
+	return &Progress{
+		now:       now,
+		start:     now(),
+		parallel:  parallel,
+		durations: make([]time.Duration, 0, durationWindow),
+	}
+}
+
+// Queue counts a job read from the stdin.
+func (p *Progress) Queue() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queued++
+}
+
+// EndInput marks the stdin fully read, so that the total is known.
+func (p *Progress) EndInput() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inputEnded = true
+}
+
+// Start counts a job that started running.
+func (p *Progress) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running++
+}
+
+// Finish counts the finished job. Jobs without any attempts such as skipped jobs must not have been started.
+func (p *Progress) Finish(result JobResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if result.Err != nil {
+		p.failed++
+	}
+	if result.Attempts == 0 {
+		return
+	}
+	p.running--
+	if len(p.durations) < durationWindow {
+		p.durations = append(p.durations, result.Duration)
+	} else {
+		p.durations[p.next] = result.Duration
+	}
+	p.next = (p.next + 1) % durationWindow
+}
+
+// String returns the progress in a line such as "12/100 done, 3 running, 1 failed, 4.0 jobs/min, elapsed 3m0s, ETA 33m".
+func (p *Progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := p.now().Sub(p.start)
+	total := "?"
+	if p.inputEnded {
+		total = strconv.Itoa(p.queued)
+	}
+
+	var throughput float64
+	if elapsed > 0 {
+		throughput = float64(p.done) / elapsed.Minutes()
+	}
+
+	line := fmt.Sprintf("%d/%s done, %d running, %d failed, %.1f jobs/min, elapsed %s", p.done, total, p.running, p.failed, throughput, elapsed.Round(time.Second))
+	if p.inputEnded {
+		line += ", ETA " + p.eta()
+	}
+	return line
+}
+
+// eta estimates the remaining time by the moving average of the job durations. The caller must hold the lock.
+func (p *Progress) eta() string {
+	remaining := p.queued - p.done
+	if remaining <= 0 {
+		return "0s"
+	}
+	if len(p.durations) == 0 {
+		return "?"
+	}
+	var sum time.Duration
+	for _, d := range p.durations {
+		sum += d
+	}
+	average := sum / time.Duration(len(p.durations))
+	rounds := (remaining + p.parallel - 1) / p.parallel
+	return (average * time.Duration(rounds)).Round(time.Second).String()
+}
+
+// ReportProgress writes the progress to out until done is closed. It redraws a single line if tty is true, or writes a
+// line every interval otherwise. The final progress is written when done is closed.
+func ReportProgress(p *Progress, out *Output, tty bool, interval time.Duration, done <-chan struct{}) {
+	if tty {
+		interval = ttyRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if tty {
+				out.SetStatus("Progress: " + p.String())
+			} else {
+				out.Stderrf("Progress: %s\n", p.String())
+			}
+		case <-done:
+			if tty {
+				out.SetStatus("")
+			}
+			out.Stderrf("Progress: %s\n", p.String())
+			return
+		}
+	}
+}
+
+// IsTerminal returns whether w is a terminal.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The directories of a queue. A job is a file named by the hash of its input line, which moves from pending to running
+// when claimed, and then to done or failed. Files are written to tmp and then linked to pending.
+const (
+	queuePending = "pending"
+	queueRunning = "running"
+	queueDone    = "done"
+	queueFailed  = "failed"
+	queueTmp     = "tmp"
+)
+
+// QueueOptions is how to share the jobs with other runners through a directory.
+type QueueOptions struct {
+	// Dir is the directory of the queue, or empty if the jobs are read from the stdin directly.
+	Dir string
+	// Worker only runs the jobs in the queue without adding the stdin to it.
+	Worker bool
+	// Lease is the duration a claim lasts without being renewed. Claims of crashed runners are reclaimed after it.
+	Lease time.Duration
+	// Poll is the interval to look for new or reclaimed jobs while other runners are running jobs.
+	Poll time.Duration
+}
+
+// Queue is a Source of the jobs in a maildir-style directory shared by multiple runners. Jobs are claimed by renaming
+// them from pending to running, which only one runner can do. Running jobs are touched every third of the lease while
+// their runners are alive, and moved back to pending by any runner after the lease expires.
+type Queue struct {
+	options QueueOptions
+	// input is the source of the jobs to add to the queue, or nil if not adding.
+	input *LineSource
+	now   func() time.Time
+
+	// pending is the cached names of the pending jobs to claim, and reclaimedAt is when the expired jobs were reclaimed
+	// last. They are used only by Claim.
+	pending     []string
+	reclaimedAt time.Time
+
+	mu      sync.Mutex
+	seq     int
+	claimed map[string]struct{}
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var _ Source = &Queue{}
+
+// NewQueue creates the directories of the queue and starts renewing the claims until Close.
+func NewQueue(options QueueOptions, input *LineSource) (*Queue, error) {
+	for _, dir := range []string{queuePending, queueRunning, queueDone, queueFailed, queueTmp} {
+		if err := os.MkdirAll(filepath.Join(options.Dir, dir), 0755); err != nil {
+			return nil, fmt.Errorf("NewQueue: %w", err)
+		}
+	}
+
+	q := &Queue{
+		options: options,
+		input:   input,
+		now:     time.Now,
+		claimed: make(map[string]struct{}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go q.renew()
+	return q, nil
+}
+
+func (q *Queue) path(dir, name string) string {
+	return filepath.Join(q.options.Dir, dir, name)
+}
+
+// QueueName returns the name of the job file of the input line.
+func QueueName(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Add adds the input line to pending unless it is already in the queue in any state. It returns whether it is added.
+func (q *Queue) Add(line string) (bool, error) {
+	name := QueueName(line)
+	// This check only avoids writing lines already in the queue. It may miss a job moving between the directories, such
+	// as one reclaimed from running to pending, so linking below is what makes adding idempotent.
+	for _, dir := range []string{queuePending, queueRunning, queueDone, queueFailed} {
+		if _, err := os.Lstat(q.path(dir, name)); err == nil {
+			return false, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("Queue.Add: %w", err)
+		}
+	}
+
+	tmpPath := q.path(queueTmp, fmt.Sprintf("%s.%08x", name, rand.Uint32()))
+	if err := os.WriteFile(tmpPath, []byte(line), 0644); err != nil {
+		return false, fmt.Errorf("Queue.Add: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	// Linking fails if the job is already pending, unlike renaming, so the same line is never pending twice.
+	if err := os.Link(tmpPath, q.path(queuePending, name)); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Queue.Add: %w", err)
+	}
+	return true, nil
+}
+
+// Claim claims a pending job. It returns false if no jobs are pending. The names of the pending jobs are cached until
+// they are exhausted, so that the directory is not listed for each claim, and the expired jobs are reclaimed at most
+// once per the poll interval.
+func (q *Queue) Claim() (Job, bool, error) {
+	if now := q.now(); now.Sub(q.reclaimedAt) >= q.options.Poll {
+		if err := q.reclaim(); err != nil {
+			return Job{}, false, fmt.Errorf("Queue.Claim: %w", err)
+		}
+		q.reclaimedAt = now
+	}
+
+	listed := false
+	for {
+		if len(q.pending) == 0 {
+			if listed {
+				return Job{}, false, nil
+			}
+			names, err := q.names(queuePending)
+			if err != nil {
+				return Job{}, false, fmt.Errorf("Queue.Claim: %w", err)
+			}
+			listed = true
+			if len(names) == 0 {
+				continue
+			}
+			// Runners start at random points so that they rarely race for the same jobs.
+			offset := rand.IntN(len(names))
+			q.pending = append(names[offset:], names[:offset]...)
+		}
+		name := q.pending[0]
+		q.pending = q.pending[1:]
+
+		pendingPath := q.path(queuePending, name)
+		runningPath := q.path(queueRunning, name)
+
+		// The lease starts before renaming, so that other runners never see the claim expired.
+		now := q.now()
+		if err := os.Chtimes(pendingPath, now, now); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return Job{}, false, fmt.Errorf("Queue.Claim: %w", err)
+		}
+		if err := os.Rename(pendingPath, runningPath); err != nil {
+			// Another runner claimed it first.
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return Job{}, false, fmt.Errorf("Queue.Claim: %w", err)
+		}
+
+		bs, err := os.ReadFile(runningPath)
+		if err != nil {
+			return Job{}, false, fmt.Errorf("Queue.Claim: %w", err)
+		}
+
+		q.mu.Lock()
+		q.seq++
+		seq := q.seq
+		q.claimed[name] = struct{}{}
+		q.mu.Unlock()
+		return Job{Seq: seq, Line: string(bs), ID: name}, true, nil
+	}
+}
+
+// reclaim moves the running jobs whose leases expired back to pending.
+func (q *Queue) reclaim() error {
+	running, err := q.list(queueRunning)
+	if err != nil {
+		return fmt.Errorf("Queue.reclaim: %w", err)
+	}
+
+	for _, stat := range running {
+		if q.isClaimed(stat.Name()) || q.now().Sub(stat.ModTime()) <= q.options.Lease {
+			continue
+		}
+		if err := os.Rename(q.path(queueRunning, stat.Name()), q.path(queuePending, stat.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Queue.reclaim: %w", err)
+		}
+	}
+	return nil
+}
+
+// names returns the names of the job files in the directory without stat-ing them.
+func (q *Queue) names(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(q.options.Dir, dir))
+	if err != nil {
+		return nil, fmt.Errorf("Queue.names: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// list returns the job files in the directory.
+func (q *Queue) list(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(q.options.Dir, dir))
+	if err != nil {
+		return nil, fmt.Errorf("Queue.list: %w", err)
+	}
+
+	stats := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("Queue.list: %w", err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// Feed adds the input to the queue if any, and then passes the claimed jobs to send. While no jobs are pending but
+// some are running, it polls the queue because they may be reclaimed.
+func (q *Queue) Feed(ctx context.Context, send func(Job) bool) error {
+	if q.input != nil {
+		var err error
+		feedErr := q.input.Feed(ctx, func(job Job) bool {
+			_, err = q.Add(job.Line)
+			return ctx.Err() == nil && err == nil
+		})
+		if err != nil {
+			return fmt.Errorf("Queue.Feed: %w", err)
+		}
+		if feedErr != nil {
+			return fmt.Errorf("Queue.Feed: %w", feedErr)
+		}
+	}
+
+	for ctx.Err() == nil {
+		job, ok, err := q.Claim()
+		if err != nil {
+			return fmt.Errorf("Queue.Feed: %w", err)
+		}
+		if ok {
+			if !send(job) {
+				return nil
+			}
+			continue
+		}
+
+		running, err := q.names(queueRunning)
+		if err != nil {
+			return fmt.Errorf("Queue.Feed: %w", err)
+		}
+		if len(running) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(q.options.Poll):
+		}
+	}
+	return nil
+}
+
+// Finish moves the job to done or failed. Canceled jobs are moved back to pending for other runners. Jobs reclaimed by
+// other runners are left to them.
+func (q *Queue) Finish(job Job, result JobResult) error {
+	if job.ID == "" {
+		return nil
+	}
+	if result.Kind == FailureCanceled {
+		return q.Release(job)
+	}
+
+	dir := queueDone
+	if result.Err != nil {
+		dir = queueFailed
+	}
+	if err := q.move(job, dir); err != nil {
+		return fmt.Errorf("Queue.Finish: %w", err)
+	}
+	return nil
+}
+
+// Release moves the job back to pending for other runners.
+func (q *Queue) Release(job Job) error {
+	if job.ID == "" {
+		return nil
+	}
+	if err := q.move(job, queuePending); err != nil {
+		return fmt.Errorf("Queue.Release: %w", err)
+	}
+	return nil
+}
+
+func (q *Queue) move(job Job, dir string) error {
+	q.mu.Lock()
+	delete(q.claimed, job.ID)
+	q.mu.Unlock()
+
+	if err := os.Rename(q.path(queueRunning, job.ID), q.path(dir, job.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Queue.move: %w", err)
+	}
+	return nil
+}
+
+func (q *Queue) isClaimed(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.claimed[name]
+	return ok
+}
+
+// renew touches the claimed jobs every third of the lease until Close.
+func (q *Queue) renew() {
+	defer close(q.stopped)
+	ticker := time.NewTicker(q.options.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+
+		q.mu.Lock()
+		names := make([]string, 0, len(q.claimed))
+		for name := range q.claimed {
+			names = append(names, name)
+		}
+		q.mu.Unlock()
+
+		now := q.now()
+		for _, name := range names {
+			// The job may have been reclaimed by another runner after a long pause such as a suspend.
+			_ = os.Chtimes(q.path(queueRunning, name), now, now)
+		}
+	}
+}
+
+// Close stops renewing the claims. Jobs still claimed are reclaimed by other runners after the lease expires.
+func (q *Queue) Close() error {
+	close(q.stop)
+	<-q.stopped
+	return nil
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the maximum number of attempts per period. The zero value means no limit.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// NoRateLimit is the rate limit that never limits.
+var NoRateLimit = RateLimit{}
+
+// ParseRateLimit parses a rate limit such as "10/s", "50/m" or "1000/h". An empty string means no limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return NoRateLimit, nil
+	}
+
+	countRaw, unit, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("ParseRateLimit: must be <count>/<unit>: %q", s)
+	}
+
+	count, err := strconv.Atoi(countRaw)
+	if err != nil || count < 1 {
+		return RateLimit{}, fmt.Errorf("ParseRateLimit: count must be a positive integer: %q", s)
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s", "sec", "second":
+		per = time.Second
+	case "m", "min", "minute":
+		per = time.Minute
+	case "h", "hour":
+		per = time.Hour
+	default:
+		return RateLimit{}, fmt.Errorf("ParseRateLimit: unit must be s, m or h: %q", s)
+	}
+	return RateLimit{Count: count, Per: per}, nil
+}
+
+// String returns the rate limit in the syntax of ParseRateLimit.
+func (l RateLimit) String() string {
+	if l.Count == 0 {
+		return ""
+	}
+	var unit string
+	switch l.Per {
+	case time.Second:
+		unit = "s"
+	case time.Minute:
+		unit = "m"
+	case time.Hour:
+		unit = "h"
+	default:
+		unit = l.Per.String()
+	}
+	return fmt.Sprintf("%d/%s", l.Count, unit)
+}
+
+// TokenBucket limits the rate of attempts shared by all workers. A token is added every interval up to burst, and each
+// attempt takes a token.
+type TokenBucket struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	interval time.Duration
+	burst    int
+	// tokens is negative if attempts have reserved the tokens to be added.
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a TokenBucket that is full at first. It returns nil for no limit, which never blocks.
+func NewTokenBucket(limit RateLimit, burst int, now func() time.Time) *TokenBucket {
+	if limit.Count == 0 {
+		return nil
+	}
+	return &TokenBucket{
+		now:      now,
+		interval: limit.Per / time.Duration(limit.Count),
+		burst:    burst,
+		tokens:   float64(burst),
+		last:     now(),
+	}
+}
+
+// Reserve takes a token and returns the delay until the token is available.
+func (b *TokenBucket) Reserve() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens = min(float64(b.burst), b.tokens+float64(now.Sub(b.last))/float64(b.interval))
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.interval))
+}
+
+// Cancel gives back a reserved token that is not used, so that other attempts can take it.
+func (b *TokenBucket) Cancel() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(float64(b.burst), b.tokens+1)
+}
+
+// Wait takes a token and waits until it is available or ctx is canceled. The token is given back if ctx is canceled.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	delay := b.Reserve()
+	if delay == 0 {
+		if err := ctx.Err(); err != nil {
+			b.Cancel()
+			return err
+		}
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.Cancel()
+		return fmt.Errorf("TokenBucket.Wait: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+type JobResult struct {
+	Seq      int
+	Line     string
+	Attempts int
+	// Start is when the first attempt started.
+	Start time.Time
+	// Duration is the total duration of all attempts excluding backoff delays.
+	Duration time.Duration
+	ExitCode int
+	Signal   string
+	Kind     FailureKind
+	Err      error
+	// Skipped is true if the job was not executed because its output already exists.
+	Skipped bool
+	// Cached is true if the result was replayed from the cache.
+	Cached bool
+	// NotStarted is true if no attempts started the command.
+	NotStarted bool
+}
+
+type Report struct {
+	mu      sync.Mutex
+	Results []JobResult
+	// Unfinished is the jobs that were not started or not read because the run was halting.
+	Unfinished []Job
+	// JobLog is nil if no job log is written.
+	JobLog *JobLog
+}
+
+func NewReport(jobLog *JobLog) *Report {
+	return &Report{Results: make([]JobResult, 0), Unfinished: make([]Job, 0), JobLog: jobLog}
+}
+
+func (r *Report) Add(result JobResult) error {
+	r.mu.Lock()
+	r.Results = append(r.Results, result)
+	r.mu.Unlock()
+
+	if r.JobLog != nil {
+		if err := r.JobLog.Write(result); err != nil {
+			return fmt.Errorf("Report.Add: %w", err)
+		}
+	}
+	return nil
+}
+
+// Counts returns the number of finished jobs and failed jobs in them. Skipped jobs are not counted, and canceled jobs
+// are not counted as failed.
+func (r *Report) Counts() (finished, failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, result := range r.Results {
+		if result.Skipped {
+			continue
+		}
+		finished++
+		if result.Err != nil && result.Kind != FailureCanceled {
+			failed++
+		}
+	}
+	return finished, failed
+}
+
+// Failed returns the results of the failed jobs. Canceled jobs are not failed but unfinished.
+func (r *Report) Failed() []JobResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := make([]JobResult, 0)
+	for _, result := range r.Results {
+		if result.Err != nil && result.Kind != FailureCanceled {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// WriteFailures writes the inputs of the failed jobs with the number of attempts.
+func (r *Report) WriteFailures(w io.Writer) {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Failed inputs (%d):\n", len(failed))
+	for _, result := range failed {
+		fmt.Fprintf(w, "  %q (%s, attempts: %d): %s\n", result.Line, result.Kind, result.Attempts, result.Err)
+	}
+}
+
+// AddUnfinished records the job that was not started or not read because the run was halting.
+func (r *Report) AddUnfinished(job Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Unfinished = append(r.Unfinished, job)
+}
+
+// Snapshot returns a copy of the results.
+func (r *Report) Snapshot() []JobResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.Results)
+}
+
+// UnfinishedJobs returns the canceled jobs and the jobs that were not started or not read in the order of the input.
+func (r *Report) UnfinishedJobs() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unfinished := make([]Job, 0, len(r.Unfinished))
+	for _, result := range r.Results {
+		if result.Kind == FailureCanceled {
+			unfinished = append(unfinished, Job{Seq: result.Seq, Line: result.Line})
+		}
+	}
+	unfinished = append(unfinished, r.Unfinished...)
+	slices.SortFunc(unfinished, func(a, b Job) int { return a.Seq - b.Seq })
+	return unfinished
+}
+
+// WriteUnfinished writes the inputs of the unfinished jobs, so that they can be resumed.
+func (r *Report) WriteUnfinished(w io.Writer) {
+	unfinished := r.UnfinishedJobs()
+	if len(unfinished) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Unfinished inputs (%d):\n", len(unfinished))
+	for _, job := range unfinished {
+		fmt.Fprintf(w, "  %q\n", job.Line)
+	}
+}
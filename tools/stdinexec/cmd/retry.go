@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"time"
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per job including the first one.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// ExitCodes are the exit codes to retry. If both ExitCodes and StderrPattern are empty, any failure is retried.
+	ExitCodes     []int
+	StderrPattern *regexp.Regexp
+}
+
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// Retryable returns whether the failed attempt should be retried. Timed out attempts and attempts that did not write the
+// expected output are always retryable, and attempts that could not be started are never retryable.
+func (p RetryPolicy) Retryable(attempt Attempt) bool {
+	switch attempt.Kind {
+	case FailureTimedOut, FailurePostCondition:
+		return true
+	case FailureError, FailureCanceled:
+		return false
+	}
+	if len(p.ExitCodes) == 0 && p.StderrPattern == nil {
+		return true
+	}
+	if slices.Contains(p.ExitCodes, attempt.ExitCode) {
+		return true
+	}
+	if p.StderrPattern != nil && p.StderrPattern.Match(attempt.Stderr) {
+		return true
+	}
+	return false
+}
+
+// Backoff returns the delay before the next attempt of the failed attempt, that is exponential to the attempt
+// and has a jitter in [d/2, d]. MaxDelay of zero or less means no cap.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
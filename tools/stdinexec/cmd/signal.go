@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// handleSignals stops starting new jobs and forwards the signal to the running commands on the first signal, and kills
+// the running commands on the second signal. It returns when done is closed.
+func handleSignals(sigs <-chan os.Signal, done <-chan struct{}, halter *Halter, out *Output) {
+	for n := 0; ; n++ {
+		select {
+		case sig := <-sigs:
+			if n == 0 {
+				out.Stderrf("Received %s. Waiting for running jobs to exit. Send it again to kill them.\n", sig)
+				halter.Interrupt(sig)
+			} else {
+				out.Stderrf("Received %s again. Killing running jobs.\n", sig)
+				halter.Kill()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Interrupt stops starting new jobs and forwards sig to the process groups of the running commands.
+func (h *Halter) Interrupt(sig os.Signal) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.interrupted != nil {
+		return
+	}
+	h.interrupted = sig
+	h.stopDispatch()
+	h.stopAttempts()
+	for cmd := range h.running {
+		_ = signalProcessGroup(cmd, toSyscallSignal(sig))
+	}
+}
+
+// Kill stops starting new jobs and kills the process groups of the running commands immediately.
+func (h *Halter) Kill() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.killed = true
+	h.stopDispatch()
+	h.killJobs()
+	for cmd := range h.running {
+		_ = signalProcessGroup(cmd, syscall.SIGKILL)
+	}
+}
+
+// Interrupted returns the received signal, or nil if no signal is received.
+func (h *Halter) Interrupted() os.Signal {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.interrupted
+}
+
+// track registers the started command to forward signals to until the returned function is called. The command is
+// signaled immediately if a signal has already been received.
+func (h *Halter) track(cmd *exec.Cmd) (untrack func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running[cmd] = struct{}{}
+	if h.killed {
+		_ = signalProcessGroup(cmd, syscall.SIGKILL)
+	} else if h.interrupted != nil {
+		_ = signalProcessGroup(cmd, toSyscallSignal(h.interrupted))
+	}
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.running, cmd)
+	}
+}
+
+func toSyscallSignal(sig os.Signal) syscall.Signal {
+	if s, ok := sig.(syscall.Signal); ok {
+		return s
+	}
+	return syscall.SIGTERM
+}
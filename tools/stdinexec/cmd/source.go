@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Kuniwak/ai-cli-tools/lines"
+)
+
+// Source is where the jobs come from.
+type Source interface {
+	// Feed passes the jobs to send until no jobs remain, ctx is done, or send returns false.
+	Feed(ctx context.Context, send func(Job) bool) error
+	// Finish is called with the result of each job passed to send.
+	Finish(job Job, result JobResult) error
+	// Release is called with each job passed to send but not finished, such as when halting.
+	Release(job Job) error
+	Close() error
+}
+
+// NewSource returns the source of the jobs specified by the options. The inputs in succeeded are skipped. The inputs
+// left unread after dispatching stops are passed to unsent, except for queues whose jobs stay pending.
+func NewSource(options *Options, succeeded map[string]struct{}, unsent func(Job)) (Source, error) {
+	if options.Queue.Dir == "" {
+		return &LineSource{Reader: options.Reader, Null: options.Null, Succeeded: succeeded, Unsent: unsent}, nil
+	}
+	var input *LineSource
+	if !options.Queue.Worker {
+		input = &LineSource{Reader: options.Reader, Null: options.Null, Succeeded: succeeded}
+	}
+	queue, err := NewQueue(options.Queue, input)
+	if err != nil {
+		return nil, fmt.Errorf("NewSource: %w", err)
+	}
+	return queue, nil
+}
+
+// LineSource reads the jobs from the lines of the reader.
+type LineSource struct {
+	Reader io.Reader
+	// Null separates the lines by null bytes instead of newlines.
+	Null bool
+	// Succeeded is the inputs to skip.
+	Succeeded map[string]struct{}
+	// Unsent is called with each remaining job after send returns false or ctx is done, so that they can be resumed. If
+	// nil, the remaining lines are not read.
+	Unsent func(Job)
+}
+
+var _ Source = &LineSource{}
+
+func (s *LineSource) Feed(ctx context.Context, send func(Job) bool) error {
+	scanner := bufio.NewScanner(s.Reader)
+	scanner.Split(lines.NewScanFunc(s.Null))
+	seq := 0
+	for scanner.Scan() {
+		seq++
+		line := scanner.Text()
+		if _, ok := s.Succeeded[line]; ok {
+			continue
+		}
+		job := Job{Seq: seq, Line: line}
+		if ctx.Err() != nil {
+			if s.Unsent == nil {
+				return nil
+			}
+			s.Unsent(job)
+		} else if send(job) {
+			continue
+		} else if s.Unsent == nil {
+			return nil
+		}
+		s.drain(scanner, seq)
+		break
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("LineSource.Feed: failed to scan lines: %w", err)
+	}
+	return nil
+}
+
+// drain passes the remaining lines to Unsent without sending them.
+func (s *LineSource) drain(scanner *bufio.Scanner, seq int) {
+	for scanner.Scan() {
+		seq++
+		line := scanner.Text()
+		if _, ok := s.Succeeded[line]; ok {
+			continue
+		}
+		s.Unsent(Job{Seq: seq, Line: line})
+	}
+}
+
+func (s *LineSource) Finish(Job, JobResult) error {
+	return nil
+}
+
+func (s *LineSource) Release(Job) error {
+	return nil
+}
+
+func (s *LineSource) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// shellMetacharacters is the characters that have special meanings in POSIX shells including blanks.
+const shellMetacharacters = "|&;<>()$`\\\"' \t*?[]#~!{}"
+
+// unquotedReplacementStrings is the replacement strings derived from the input line without quoting.
+var unquotedReplacementStrings = []string{"{}", "{.}", "{/}", "{//}", "{/.}"}
+
+// shells is the names of the shells whose scripts are checked.
+var shells = []string{"sh", "bash", "zsh", "dash"}
+
+// shellLongOptionsWithValue is the long options of the shells that take the next argument as their values.
+var shellLongOptionsWithValue = []string{"--rcfile", "--init-file"}
+
+// shellLongOptions is the long options of the shells without values.
+var shellLongOptions = []string{"--norc", "--noprofile", "--login", "--posix", "--noediting", "--restricted", "--verbose", "--version", "--help"}
+
+// UsesUnquotedLineInScript returns whether a replacement string derived from the input line is used without {q} in the
+// script argument of "-c" of a shell, such as "sh -c" or "env bash -o pipefail -ec". It returns an error if the
+// arguments of a shell cannot be parsed, so that unknown options never hide a script.
+func UsesUnquotedLineInScript(commandAndArgs []string) (bool, error) {
+	for i, arg := range commandAndArgs {
+		if !slices.Contains(shells, filepath.Base(arg)) {
+			continue
+		}
+		script, ok, err := shellScript(commandAndArgs[i+1:])
+		if err != nil {
+			return false, fmt.Errorf("UsesUnquotedLineInScript: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		for _, s := range unquotedReplacementStrings {
+			if strings.Contains(script, s) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// shellScript returns the script of the arguments of a shell if the options include "-c". The script is the first
+// argument that is neither an option nor the value of -o, +o, -O, +O, --rcfile or --init-file.
+func shellScript(args []string) (string, bool, error) {
+	command := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--" || arg == "-":
+			i++
+			if !command {
+				return "", false, nil
+			}
+			if i >= len(args) {
+				return "", false, fmt.Errorf("shellScript: no script after -c: %q", args)
+			}
+			return args[i], true, nil
+		case slices.Contains(shellLongOptionsWithValue, arg):
+			i++
+		case slices.Contains(shellLongOptions, arg):
+		case strings.HasPrefix(arg, "--"):
+			return "", false, fmt.Errorf("shellScript: unknown shell option %q", arg)
+		case strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "+"):
+			for _, flag := range arg[1:] {
+				switch flag {
+				case 'c':
+					command = true
+				case 'o', 'O':
+					// The values of options in a group such as -eo pipefail follow in order.
+					i++
+				}
+			}
+		default:
+			return arg, command, nil
+		}
+		if i >= len(args) {
+			return "", false, fmt.Errorf("shellScript: missing value of shell option %q", arg)
+		}
+	}
+	if command {
+		return "", false, fmt.Errorf("shellScript: no script after -c: %q", args)
+	}
+	return "", false, nil
+}
+
+// ValidateLine returns an error if the line contains NUL, newline or shell metacharacters.
+func ValidateLine(line string) error {
+	if i := strings.IndexAny(line, "\x00\n"+shellMetacharacters); i >= 0 {
+		return fmt.Errorf("ValidateLine: unsafe character %q in input line %q, use {q} instead", line[i], line)
+	}
+	return nil
+}
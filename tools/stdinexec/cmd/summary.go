@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+const (
+	// ExitOK is the exit status when all jobs succeeded or were skipped.
+	ExitOK = 0
+	// ExitJobsFailed is the exit status when some jobs failed or the run was halted by the halt policy.
+	ExitJobsFailed = 1
+	// ExitRunnerError is the exit status when stdinexec itself failed, such as invalid options or an unwritable job log.
+	ExitRunnerError = 2
+	// exitSignalBase is added to the signal number for the exit status when interrupted by a signal, like shells do.
+	exitSignalBase = 128
+)
+
+// slowestJobs is the number of the slowest jobs in the summary.
+const slowestJobs = 5
+
+// ExitError is an error with the exit status of the process.
+type ExitError struct {
+	ExitStatus int
+	Err        error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Summary is the statistics of a run.
+type Summary struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// TimedOut is the number of failed jobs whose last attempts timed out.
+	TimedOut int `json:"timed_out"`
+	// Retried is the number of jobs that were attempted more than once.
+	Retried int `json:"retried"`
+	Skipped int `json:"skipped"`
+	// Cached is the number of jobs whose results were replayed from the cache.
+	Cached int `json:"cached"`
+	// Unfinished is the number of jobs that were canceled or not started by halting. Canceled jobs are not failed.
+	Unfinished         int                 `json:"unfinished"`
+	Elapsed            float64             `json:"elapsed"`
+	Slowest            []SlowJob           `json:"slowest"`
+	ConcurrencyChanges []ConcurrencyChange `json:"concurrency_changes"`
+	ExitStatus         int                 `json:"exit_status"`
+	elapsed            time.Duration
+}
+
+// SlowJob is a job in the slowest jobs. Jobs whose commands never started are not included.
+type SlowJob struct {
+	Seq   int    `json:"seq"`
+	Input string `json:"input"`
+	// Duration is the total duration of all attempts in seconds.
+	Duration float64 `json:"duration"`
+	Attempts int     `json:"attempts"`
+	duration time.Duration
+}
+
+// NewSummary summarizes the report of the run that took elapsed and exited with exitStatus.
+func NewSummary(report *Report, concurrency *Concurrency, elapsed time.Duration, exitStatus int) Summary {
+	summary := Summary{
+		Elapsed:            elapsed.Seconds(),
+		Slowest:            make([]SlowJob, 0, slowestJobs),
+		ConcurrencyChanges: make([]ConcurrencyChange, 0),
+		ExitStatus:         exitStatus,
+		elapsed:            elapsed,
+	}
+
+	if history := concurrency.History(); history != nil {
+		summary.ConcurrencyChanges = history
+	}
+
+	results := report.Snapshot()
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			summary.Skipped++
+		case result.Kind == FailureCanceled:
+			// Counted as unfinished below.
+		case result.Err != nil:
+			summary.Failed++
+		default:
+			summary.Succeeded++
+		}
+		if result.Kind == FailureTimedOut {
+			summary.TimedOut++
+		}
+		if result.Attempts > 1 {
+			summary.Retried++
+		}
+		if result.Cached {
+			summary.Cached++
+		}
+	}
+	summary.Unfinished = len(report.UnfinishedJobs())
+
+	slices.SortStableFunc(results, func(a, b JobResult) int { return cmp.Compare(b.Duration, a.Duration) })
+	for _, result := range results {
+		if len(summary.Slowest) >= slowestJobs {
+			break
+		}
+		if result.Attempts == 0 || result.NotStarted {
+			continue
+		}
+		summary.Slowest = append(summary.Slowest, SlowJob{
+			Seq:      result.Seq,
+			Input:    result.Line,
+			Duration: result.Duration.Seconds(),
+			Attempts: result.Attempts,
+			duration: result.Duration,
+		})
+	}
+	return summary
+}
+
+// Write writes the summary in a human-readable form.
+func (s Summary) Write(w io.Writer) {
+	fmt.Fprintf(w, "Summary: %d succeeded, %d failed (%d timed out), %d retried, %d skipped, %d cached, %d unfinished in %s\n", s.Succeeded, s.Failed, s.TimedOut, s.Retried, s.Skipped, s.Cached, s.Unfinished, s.elapsed.Round(time.Millisecond))
+	if len(s.Slowest) > 0 {
+		fmt.Fprintf(w, "Slowest jobs:\n")
+		for _, job := range s.Slowest {
+			fmt.Fprintf(w, "  %q %s (attempts: %d)\n", job.Input, job.duration.Round(time.Millisecond), job.Attempts)
+		}
+	}
+	if len(s.ConcurrencyChanges) > 0 {
+		fmt.Fprintf(w, "Concurrency changes (%d):\n", len(s.ConcurrencyChanges))
+		for _, change := range s.ConcurrencyChanges {
+			fmt.Fprintf(w, "  %s %d -> %d: %s\n", change.Time.Format(time.RFC3339), change.From, change.To, change.Reason)
+		}
+	}
+}
+
+// WriteJSON writes the summary in JSON.
+func (s Summary) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s); err != nil {
+		return fmt.Errorf("Summary.WriteJSON: %w", err)
+	}
+	return nil
+}
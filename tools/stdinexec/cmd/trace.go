@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// tracePID is the process ID of all tracks in the trace, which has only one process.
+const tracePID = 1
+
+// TraceEvent is an event of the Chrome Trace Event Format, which Perfetto and chrome://tracing can open.
+type TraceEvent struct {
+	Name string `json:"name"`
+	Cat  string `json:"cat,omitzero"`
+	// Ph is the phase: "X" for complete events and "M" for metadata events.
+	Ph string `json:"ph"`
+	// Ts is the start time in microseconds since the run started.
+	Ts float64 `json:"ts"`
+	// Dur is the duration in microseconds for complete events.
+	Dur  float64        `json:"dur,omitzero"`
+	PID  int            `json:"pid"`
+	TID  int            `json:"tid"`
+	Args map[string]any `json:"args,omitzero"`
+}
+
+// Trace records the attempts as spans on the tracks of the worker slots. Nil means no trace is recorded.
+type Trace struct {
+	mu     sync.Mutex
+	start  time.Time
+	slots  int
+	events []TraceEvent
+}
+
+// NewTrace returns a Trace of the run started at start with the number of worker slots.
+func NewTrace(start time.Time, slots int) *Trace {
+	return &Trace{start: start, slots: slots, events: make([]TraceEvent, 0)}
+}
+
+// Add records the attempt of the job as a span on the track of the slot.
+func (t *Trace) Add(slot int, job Job, number int, attempt Attempt) {
+	if t == nil {
+		return
+	}
+
+	args := map[string]any{
+		"seq":       job.Seq,
+		"attempt":   number,
+		"exit_code": attempt.ExitCode,
+	}
+	if attempt.Kind != FailureNone {
+		args["failure"] = string(attempt.Kind)
+	}
+	if attempt.Signal != "" {
+		args["signal"] = attempt.Signal
+	}
+	if attempt.Cached {
+		args["cached"] = true
+	}
+
+	cat := "attempt"
+	if number > 1 {
+		cat = "retry"
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, TraceEvent{
+		Name: job.Line,
+		Cat:  cat,
+		Ph:   "X",
+		Ts:   microseconds(attempt.Start.Sub(t.start)),
+		Dur:  microseconds(attempt.Duration),
+		PID:  tracePID,
+		TID:  slot,
+		Args: args,
+	})
+}
+
+func microseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// Write writes the trace in the JSON object format with the names of the tracks, so that idle slots are also shown.
+func (t *Trace) Write(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events := make([]TraceEvent, 0, len(t.events)+t.slots+1)
+	events = append(events, TraceEvent{Name: "process_name", Ph: "M", PID: tracePID, Args: map[string]any{"name": "stdinexec"}})
+	for slot := 1; slot <= t.slots; slot++ {
+		events = append(events,
+			TraceEvent{Name: "thread_name", Ph: "M", PID: tracePID, TID: slot, Args: map[string]any{"name": fmt.Sprintf("slot %d", slot)}},
+			TraceEvent{Name: "thread_sort_index", Ph: "M", PID: tracePID, TID: slot, Args: map[string]any{"sort_index": slot}},
+		)
+	}
+	spans := slices.Clone(t.events)
+	slices.SortStableFunc(spans, func(a, b TraceEvent) int { return cmp.Compare(a.Ts, b.Ts) })
+	events = append(events, spans...)
+
+	trace := struct {
+		TraceEvents     []TraceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{TraceEvents: events, DisplayTimeUnit: "ms"}
+	if err := json.NewEncoder(w).Encode(trace); err != nil {
+		return fmt.Errorf("Trace.Write: %w", err)
+	}
+	return nil
+}
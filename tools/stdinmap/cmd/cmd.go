@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/lines"
+	"github.com/Kuniwak/ai-cli-tools/version"
+)
+
+func MainCommandByArgs(args []string, inout *cli.ProcInout) int {
+	options, err := ParseOptions(args, inout)
+	if err != nil {
+		fmt.Fprintln(inout.Stderr, err)
+		return 1
+	}
+	if err := MainCommandByOptions(options, inout); err != nil {
+		fmt.Fprintln(inout.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
+	if options.CommonOptions.Help {
+		return nil
+	}
+
+	if options.CommonOptions.Version {
+		fmt.Fprintln(inout.Stdout, version.Version)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(options.Reader)
+	scanner.Split(lines.NewScanFunc(options.Null))
+	for scanner.Scan() {
+		line := scanner.Text()
+		mapped, ok := options.Mapping.Map(line)
+		if !ok {
+			switch options.Unmatched {
+			case UnmatchedDrop:
+				continue
+			case UnmatchedPass:
+				mapped = line
+			case UnmatchedFail:
+				return fmt.Errorf("MainCommandByOptions: %q does not match %q", line, options.Mapping.From)
+			default:
+				panic(fmt.Sprintf("unknown unmatched policy: %q", options.Unmatched))
+			}
+		}
+		if err := lines.WriteLine(options.Null, mapped, inout.Stdout); err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to write line: %w", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("MainCommandByOptions: failed to scan lines: %w", err)
+	}
+	return nil
+}
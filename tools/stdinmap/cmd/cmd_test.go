@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/version"
+)
+
+func TestMainCommandByArgsHelp(t *testing.T) {
+	spy := cli.SpyProcInout("")
+	exitStatus := MainCommandByArgs([]string{"-h"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Errorf("expected exit status to be 0, got %d", exitStatus)
+	}
+	if spy.Stderr.String() == "" {
+		t.Errorf("expected stderr to be non-empty, got %q", spy.Stderr.String())
+	}
+}
+
+func TestMainCommandByArgsVersion(t *testing.T) {
+	spy := cli.SpyProcInout("")
+	exitStatus := MainCommandByArgs([]string{"-version"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Errorf("expected exit status to be 0, got %d", exitStatus)
+	}
+	expected := fmt.Sprintf("%s\n", version.Version)
+	if spy.Stdout.String() != expected {
+		t.Errorf("expected stdout to be %q, got %q", expected, spy.Stdout.String())
+	}
+}
+
+func TestMainCommandByArgs(t *testing.T) {
+	testCases := map[string]struct {
+		stdin              string
+		args               []string
+		expectedExitStatus int
+		expectedStdout     string
+	}{
+		"empty": {
+			stdin:              "",
+			args:               []string{"./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 0,
+			expectedStdout:     "",
+		},
+		"forward": {
+			stdin:              "./input/a.tsv\n./input/b.tsv\n",
+			args:               []string{"./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 0,
+			expectedStdout:     "./output/a.json\n./output/b.json\n",
+		},
+		"reverse": {
+			stdin:              "./output/a.json\n",
+			args:               []string{"-r", "./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 0,
+			expectedStdout:     "./input/a.tsv\n",
+		},
+		"null": {
+			stdin:              "./input/a.tsv\u0000./input/b.tsv\u0000",
+			args:               []string{"-0", "./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 0,
+			expectedStdout:     "./output/a.json\u0000./output/b.json\u0000",
+		},
+		"unmatched drop": {
+			stdin:              "./input/a.tsv\n./input/b.csv\n",
+			args:               []string{"./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 0,
+			expectedStdout:     "./output/a.json\n",
+		},
+		"unmatched pass": {
+			stdin:              "./input/a.tsv\n./input/b.csv\n",
+			args:               []string{"-u", "pass", "./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 0,
+			expectedStdout:     "./output/a.json\n./input/b.csv\n",
+		},
+		"unmatched fail": {
+			stdin:              "./input/a.tsv\n./input/b.csv\n",
+			args:               []string{"-unmatched", "fail", "./input/{name}.tsv", "./output/{name}.json"},
+			expectedExitStatus: 1,
+			expectedStdout:     "./output/a.json\n",
+		},
+		"undefined variable": {
+			stdin:              "./input/a.tsv\n",
+			args:               []string{"./input/{name}.tsv", "./output/{dir}/{name}.json"},
+			expectedExitStatus: 1,
+			expectedStdout:     "",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout(tc.stdin)
+			exitStatus := MainCommandByArgs(tc.args, spy.NewProcInout())
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expectedStdout {
+				t.Errorf("expected stdout to be %q, got %q", tc.expectedStdout, spy.Stdout.String())
+			}
+		})
+	}
+}
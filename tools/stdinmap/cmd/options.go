@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/pathpattern"
+	"github.com/Kuniwak/ai-cli-tools/tools"
+)
+
+type Unmatched string
+
+const (
+	UnmatchedDrop Unmatched = "drop"
+	UnmatchedPass Unmatched = "pass"
+	UnmatchedFail Unmatched = "fail"
+)
+
+type Options struct {
+	CommonOptions tools.CommonOptions
+	Reader        io.Reader
+	Null          bool
+	Mapping       *pathpattern.Mapping
+	Unmatched     Unmatched
+}
+
+func ParseOptions(args []string, inout *cli.ProcInout) (*Options, error) {
+	flags := flag.NewFlagSet("stdinmap", flag.ContinueOnError)
+	flags.SetOutput(inout.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(inout.Stderr, `Usage: stdinmap [-0] [-r] [-u drop|pass|fail] <from-pattern> <to-pattern> < <input>
+
+Map each line of the input matching <from-pattern> to <to-pattern>.
+"{name}" in the patterns is a variable that matches any string. Variables in <to-pattern> must be defined in <from-pattern>.
+
+Options:
+`)
+		flags.PrintDefaults()
+
+		fmt.Fprintf(inout.Stderr, `
+Examples:
+  $ printf './input/a.tsv\n./input/b.tsv\n' | stdinmap './input/{name}.tsv' './output/{name}.json'
+  ./output/a.json
+  ./output/b.json
+
+  $ # Map in the reverse direction.
+  $ printf './output/a.json\n' | stdinmap -r './input/{name}.tsv' './output/{name}.json'
+  ./input/a.tsv
+
+  $ # Drop processed files from the input.
+  $ find ./input -name '*.tsv' -print0 | stdinsub -0 <(find ./output -name '*.json' -print0 | stdinmap -0 -r './input/{name}.tsv' './output/{name}.json')
+`)
+	}
+
+	commonRawOptions := &tools.CommonRawOptions{}
+	tools.DeclareCommonFlags(flags, commonRawOptions)
+
+	null := flags.Bool("0", false, "use null byte as the record separator")
+	reverseShort := flags.Bool("r", false, "map from <to-pattern> to <from-pattern>")
+	reverseLong := flags.Bool("reverse", false, "map from <to-pattern> to <from-pattern>")
+	unmatchedShort := flags.String("u", "", "what to do with unmatched lines: drop, pass or fail (default: \"drop\")")
+	unmatchedLong := flags.String("unmatched", "", "what to do with unmatched lines: drop, pass or fail (default: \"drop\")")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return &Options{CommonOptions: tools.CommonOptions{Help: true}}, nil
+		}
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	commonOptions, err := tools.ValidateCommonOptions(commonRawOptions)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	if commonOptions.Version {
+		return &Options{CommonOptions: commonOptions}, nil
+	}
+
+	if flags.NArg() != 2 {
+		return nil, fmt.Errorf("ParseOptions: <from-pattern> and <to-pattern> are required")
+	}
+
+	from, err := pathpattern.Parse(flags.Arg(0))
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid <from-pattern>: %w", err)
+	}
+
+	to, err := pathpattern.Parse(flags.Arg(1))
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid <to-pattern>: %w", err)
+	}
+
+	if *reverseShort || *reverseLong {
+		from, to = to, from
+	}
+
+	mapping, err := pathpattern.NewMapping(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	var unmatchedRaw string
+	if *unmatchedLong != "" {
+		unmatchedRaw = *unmatchedLong
+	} else {
+		unmatchedRaw = *unmatchedShort
+	}
+
+	var unmatched Unmatched
+	switch Unmatched(unmatchedRaw) {
+	case "", UnmatchedDrop:
+		unmatched = UnmatchedDrop
+	case UnmatchedPass:
+		unmatched = UnmatchedPass
+	case UnmatchedFail:
+		unmatched = UnmatchedFail
+	default:
+		return nil, fmt.Errorf("ParseOptions: unmatched must be one of drop, pass or fail: %q", unmatchedRaw)
+	}
+
+	return &Options{
+		CommonOptions: commonOptions,
+		Reader:        inout.Stdin,
+		Null:          *null,
+		Mapping:       mapping,
+		Unmatched:     unmatched,
+	}, nil
+}
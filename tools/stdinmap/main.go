@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/tools/stdinmap/cmd"
+)
+
+func main() {
+	cli.Run(cmd.MainCommandByArgs)
+}
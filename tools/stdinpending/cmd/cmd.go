@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/lines"
+	"github.com/Kuniwak/ai-cli-tools/outputcheck"
+	"github.com/Kuniwak/ai-cli-tools/replstr"
+	"github.com/Kuniwak/ai-cli-tools/version"
+)
+
+func MainCommandByArgs(args []string, inout *cli.ProcInout) int {
+	options, err := ParseOptions(args, inout)
+	if err != nil {
+		fmt.Fprintln(inout.Stderr, err)
+		return 1
+	}
+	if err := MainCommandByOptions(options, inout); err != nil {
+		fmt.Fprintln(inout.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
+	if options.CommonOptions.Help {
+		return nil
+	}
+
+	if options.CommonOptions.Version {
+		fmt.Fprintln(inout.Stdout, version.Version)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(options.Reader)
+	scanner.Split(lines.NewScanFunc(options.Null))
+	seq := 0
+	for scanner.Scan() {
+		seq++
+		line := scanner.Text()
+		outputPath := replstr.Expand(options.OutputTemplate, replstr.Context{Line: line, Seq: seq})
+
+		err := outputcheck.Check(outputPath, line, options.Conditions)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, outputcheck.ErrNotSatisfied) {
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+
+		if err := lines.WriteLine(options.Null, line, inout.Stdout); err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to write line: %w", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("MainCommandByOptions: failed to scan lines: %w", err)
+	}
+	return nil
+}
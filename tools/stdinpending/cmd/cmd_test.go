@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/version"
+)
+
+func TestMainCommandByArgsHelp(t *testing.T) {
+	spy := cli.SpyProcInout("")
+	exitStatus := MainCommandByArgs([]string{"-h"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Errorf("expected exit status to be 0, got %d", exitStatus)
+	}
+	if spy.Stderr.String() == "" {
+		t.Errorf("expected stderr to be non-empty, got %q", spy.Stderr.String())
+	}
+}
+
+func TestMainCommandByArgsVersion(t *testing.T) {
+	spy := cli.SpyProcInout("")
+	exitStatus := MainCommandByArgs([]string{"-version"}, spy.NewProcInout())
+	if exitStatus != 0 {
+		t.Errorf("expected exit status to be 0, got %d", exitStatus)
+	}
+	expected := fmt.Sprintf("%s\n", version.Version)
+	if spy.Stdout.String() != expected {
+		t.Errorf("expected stdout to be %q, got %q", expected, spy.Stdout.String())
+	}
+}
+
+func TestMainCommandByArgs(t *testing.T) {
+	testCases := map[string]struct {
+		inputs   []string
+		null     bool
+		args     []string
+		outputs  map[string]string
+		expected []string
+	}{
+		"no outputs": {
+			inputs:   []string{"a.tsv", "b.tsv"},
+			args:     []string{"{{OUT}}/{/.}.json"},
+			outputs:  map[string]string{},
+			expected: []string{"a.tsv", "b.tsv"},
+		},
+		"some outputs": {
+			inputs:   []string{"a.tsv", "b.tsv"},
+			args:     []string{"{{OUT}}/{/.}.json"},
+			outputs:  map[string]string{"a.json": ""},
+			expected: []string{"b.tsv"},
+		},
+		"null": {
+			inputs:   []string{"a.tsv", "b.tsv"},
+			null:     true,
+			args:     []string{"-0", "{{OUT}}/{/.}.json"},
+			outputs:  map[string]string{"b.json": ""},
+			expected: []string{"a.tsv"},
+		},
+		"non-empty": {
+			inputs:   []string{"a.tsv", "b.tsv"},
+			args:     []string{"-e", "{{OUT}}/{/.}.json"},
+			outputs:  map[string]string{"a.json": "", "b.json": "{}"},
+			expected: []string{"a.tsv"},
+		},
+		"json": {
+			inputs:   []string{"a.tsv", "b.tsv"},
+			args:     []string{"-f", "json", "{{OUT}}/{/.}.json"},
+			outputs:  map[string]string{"a.json": "{\"category\": ", "b.json": "{}"},
+			expected: []string{"a.tsv"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			inDir := t.TempDir()
+			outDir := t.TempDir()
+
+			inputs := make([]string, len(tc.inputs))
+			for i, basename := range tc.inputs {
+				inputs[i] = filepath.Join(inDir, basename)
+				if err := os.WriteFile(inputs[i], []byte("input"), 0644); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+			for basename, content := range tc.outputs {
+				if err := os.WriteFile(filepath.Join(outDir, basename), []byte(content), 0644); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+
+			args := make([]string, len(tc.args))
+			for i, arg := range tc.args {
+				args[i] = strings.ReplaceAll(arg, "{{OUT}}", outDir)
+			}
+
+			sep := "\n"
+			if tc.null {
+				sep = "\u0000"
+			}
+			spy := cli.SpyProcInout(strings.Join(inputs, sep))
+			exitStatus := MainCommandByArgs(args, spy.NewProcInout())
+			if exitStatus != 0 {
+				t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+			}
+
+			expected := ""
+			for _, basename := range tc.expected {
+				expected += filepath.Join(inDir, basename) + sep
+			}
+			if spy.Stdout.String() != expected {
+				t.Errorf("expected stdout to be %q, got %q", expected, spy.Stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/outputcheck"
+	"github.com/Kuniwak/ai-cli-tools/tools"
+)
+
+type Options struct {
+	CommonOptions  tools.CommonOptions
+	Reader         io.Reader
+	Null           bool
+	OutputTemplate string
+	Conditions     outputcheck.Conditions
+}
+
+func ParseOptions(args []string, inout *cli.ProcInout) (*Options, error) {
+	flags := flag.NewFlagSet("stdinpending", flag.ContinueOnError)
+	flags.SetOutput(inout.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(inout.Stderr, `Usage: stdinpending [-0] [-e] [-newer] [-f json|jsonl] <output-template> < <input>
+
+Print the lines of the input whose output files do not exist yet.
+<output-template> is the path of the output file for each line. The following replacement strings are replaced with the line:
+  {}    the line
+  {.}   the line without extension
+  {/}   basename of the line
+  {//}  dirname of the line
+  {/.}  basename of the line without extension
+  {#}   sequence number of the line
+
+Options:
+`)
+		flags.PrintDefaults()
+
+		fmt.Fprintf(inout.Stderr, `
+Examples:
+  $ # Print ./input/*.tsv files that have no ./output/*.json files.
+  $ find ./input -name '*.tsv' | stdinpending './output/{/.}.json'
+  ./input/b.tsv
+
+  $ # Also treat empty, stale or broken outputs from crashed agents as pending.
+  $ find ./input -name '*.tsv' -print0 | stdinpending -0 -e -newer -f json './output/{/.}.json'
+
+  $ # Resume the process by Claude Code.
+  $ find ./input -name '*.tsv' -print0 \
+      | stdinpending -0 -e -f json './output/{/.}.json' \
+      | parallel -0 ./prompt_generator "{}" \
+      | parallel -j3 -0 'claude -p < "{}"'
+`)
+	}
+
+	commonRawOptions := &tools.CommonRawOptions{}
+	tools.DeclareCommonFlags(flags, commonRawOptions)
+
+	null := flags.Bool("0", false, "use null byte as the record separator")
+	nonEmptyShort := flags.Bool("e", false, "treat empty output files as pending")
+	nonEmptyLong := flags.Bool("non-empty", false, "treat empty output files as pending")
+	newer := flags.Bool("newer", false, "treat output files not newer than the input file as pending")
+	formatShort := flags.String("f", "", "treat output files not in the format as pending: json or jsonl")
+	formatLong := flags.String("format", "", "treat output files not in the format as pending: json or jsonl")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return &Options{CommonOptions: tools.CommonOptions{Help: true}}, nil
+		}
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	commonOptions, err := tools.ValidateCommonOptions(commonRawOptions)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	if commonOptions.Version {
+		return &Options{CommonOptions: commonOptions}, nil
+	}
+
+	if flags.NArg() != 1 {
+		return nil, fmt.Errorf("ParseOptions: <output-template> is required")
+	}
+
+	var formatRaw string
+	if *formatLong != "" {
+		formatRaw = *formatLong
+	} else {
+		formatRaw = *formatShort
+	}
+
+	format, err := outputcheck.ParseFormat(formatRaw)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: %w", err)
+	}
+
+	return &Options{
+		CommonOptions:  commonOptions,
+		Reader:         inout.Stdin,
+		Null:           *null,
+		OutputTemplate: flags.Arg(0),
+		Conditions: outputcheck.Conditions{
+			NonEmpty: *nonEmptyShort || *nonEmptyLong,
+			Newer:    *newer,
+			Format:   format,
+		},
+	}, nil
+}
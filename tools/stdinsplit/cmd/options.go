@@ -50,7 +50,7 @@ Examples:
   ./output/part-01.txt
 
   $ # Use with stdinexec to process each part in parallel.
-  $ echo "Hello\nWorld\n" | stdinsplit -0 -o ./output -l 1 | stdinexec -0 -p 2 bash -c 'claude -p < "{}"'`)
+  $ echo "Hello\nWorld\n" | stdinsplit -0 -o ./output -l 1 | stdinexec -0 -p 2 bash -c 'claude -p < {q}'`)
 	}
 
 	commonRawOptions := &tools.CommonRawOptions{}
@@ -39,7 +39,9 @@ func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
 		subtrahendScanner := bufio.NewScanner(subtrahend)
 		subtrahendScanner.Split(splitFunc)
 		for subtrahendScanner.Scan() {
-			m[subtrahendScanner.Text()] = struct{}{}
+			if key, ok := options.SubtrahendKey(subtrahendScanner.Text()); ok {
+				m[key] = struct{}{}
+			}
 		}
 		if err := subtrahendScanner.Err(); err != nil {
 			return fmt.Errorf("MainCommandByOptions: failed to scan subtrahend: %w", err)
@@ -51,11 +53,14 @@ func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
 	minuendScanner.Split(splitFunc)
 	for minuendScanner.Scan() {
 		minuend := minuendScanner.Text()
-		if _, ok := m[minuend]; !ok {
-			if err := lines.WriteLine(options.Null, minuend, inout.Stdout); err != nil {
-				return fmt.Errorf("MainCommandByOptions: failed to write minuend: %w", err)
+		if key, ok := options.MinuendKey(minuend); ok {
+			if _, ok := m[key]; ok {
+				continue
 			}
 		}
+		if err := lines.WriteLine(options.Null, minuend, inout.Stdout); err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to write minuend: %w", err)
+		}
 	}
 
 	if err := minuendScanner.Err(); err != nil {
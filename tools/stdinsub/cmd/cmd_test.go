@@ -96,3 +96,65 @@ func TestMainCommandByArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestMainCommandByArgsKey(t *testing.T) {
+	testCases := map[string]struct {
+		stdin    string
+		keyArgs  []string
+		files    map[string]string
+		expected string
+	}{
+		"stem": {
+			stdin:    "./input/a.tsv\n./input/b.tsv\n",
+			keyArgs:  []string{"-k", "stem"},
+			files:    map[string]string{"1": "./output/a.json\n"},
+			expected: "./input/b.tsv\n",
+		},
+		"basename and noext": {
+			stdin:    "./input/a.tsv\n./input/b.tsv\n",
+			keyArgs:  []string{"-k", "basename", "-k", "noext"},
+			files:    map[string]string{"1": "./output/b.json\n"},
+			expected: "./input/a.tsv\n",
+		},
+		"separate rules": {
+			stdin:    "./input/a.tsv\n./input/b.tsv\n",
+			keyArgs:  []string{"-mk", "noext", "-sk", "regex:^(.*)\\.done$"},
+			files:    map[string]string{"1": "./input/a.done\n./input/b.todo\n"},
+			expected: "./input/b.tsv\n",
+		},
+		"path patterns": {
+			stdin:    "./input/a.tsv\n./input/b.tsv\n",
+			keyArgs:  []string{"-minuend-key", "pattern:./input/{name}.tsv", "-subtrahend-key", "pattern:./output/{name}.json"},
+			files:    map[string]string{"1": "./output/a.json\n./output/a.log\n"},
+			expected: "./input/b.tsv\n",
+		},
+		"minuend without key": {
+			stdin:    "./input/a.tsv\n./input/b.csv\n",
+			keyArgs:  []string{"-k", "regex:^\\./[a-z]+/(.*)\\.tsv$"},
+			files:    map[string]string{"1": "./input/b.csv\n"},
+			expected: "./input/a.tsv\n./input/b.csv\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			args := append([]string{}, tc.keyArgs...)
+			for basename, content := range tc.files {
+				filePath := filepath.Join(tmpDir, basename)
+				if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				args = append(args, filePath)
+			}
+
+			spy := cli.SpyProcInout(tc.stdin)
+			exitStatus := MainCommandByArgs(args, spy.NewProcInout())
+			if exitStatus != 0 {
+				t.Fatalf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expected {
+				t.Errorf("expected stdout to be %q, got %q", tc.expected, spy.Stdout.String())
+			}
+		})
+	}
+}
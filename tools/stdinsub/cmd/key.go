@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Kuniwak/ai-cli-tools/pathpattern"
+)
+
+// KeyFunc extracts the key to compare from a line. It returns false if the line has no key.
+type KeyFunc func(line string) (string, bool)
+
+func IdentityKey(line string) (string, bool) {
+	return line, true
+}
+
+// ParseKeyRule parses one of the following rules:
+//
+//	basename           basename of the line
+//	dirname            dirname of the line
+//	noext              the line without extension
+//	stem               basename of the line without extension
+//	regex:<regexp>     the first capture group of the regexp, or the whole match if no groups
+//	pattern:<pattern>  values of the variables in the path pattern such as "./input/{name}.tsv"
+func ParseKeyRule(rule string) (KeyFunc, error) {
+	switch rule {
+	case "basename":
+		return func(line string) (string, bool) {
+			return filepath.Base(line), true
+		}, nil
+	case "dirname":
+		return func(line string) (string, bool) {
+			return filepath.Dir(line), true
+		}, nil
+	case "noext":
+		return func(line string) (string, bool) {
+			return strings.TrimSuffix(line, filepath.Ext(line)), true
+		}, nil
+	case "stem":
+		return func(line string) (string, bool) {
+			base := filepath.Base(line)
+			return strings.TrimSuffix(base, filepath.Ext(base)), true
+		}, nil
+	}
+
+	if expr, ok := strings.CutPrefix(rule, "regex:"); ok {
+		r, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("ParseKeyRule: invalid regexp: %w", err)
+		}
+		return func(line string) (string, bool) {
+			m := r.FindStringSubmatch(line)
+			if m == nil {
+				return "", false
+			}
+			if len(m) > 1 {
+				return m[1], true
+			}
+			return m[0], true
+		}, nil
+	}
+
+	if source, ok := strings.CutPrefix(rule, "pattern:"); ok {
+		p, err := pathpattern.Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("ParseKeyRule: invalid pattern: %w", err)
+		}
+		return func(line string) (string, bool) {
+			values, ok := p.Match(line)
+			if !ok {
+				return "", false
+			}
+			ss := make([]string, len(p.Variables()))
+			for i, name := range p.Variables() {
+				ss[i] = values[name]
+			}
+			return strings.Join(ss, "\t"), true
+		}, nil
+	}
+
+	return nil, fmt.Errorf("ParseKeyRule: unknown key rule: %q", rule)
+}
+
+// ChainKeyFuncs returns a KeyFunc that applies the KeyFuncs in order.
+func ChainKeyFuncs(fs []KeyFunc) KeyFunc {
+	if len(fs) == 0 {
+		return IdentityKey
+	}
+	return func(line string) (string, bool) {
+		key := line
+		for _, f := range fs {
+			var ok bool
+			key, ok = f(key)
+			if !ok {
+				return "", false
+			}
+		}
+		return key, true
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"slices"
 
 	"github.com/Kuniwak/ai-cli-tools/cli"
 	"github.com/Kuniwak/ai-cli-tools/tools"
@@ -16,15 +17,25 @@ type Options struct {
 	Null          bool
 	Minuend       io.Reader
 	Subtrahends   []io.ReadCloser
+	MinuendKey    KeyFunc
+	SubtrahendKey KeyFunc
 }
 
 func ParseOptions(args []string, inout *cli.ProcInout) (*Options, error) {
 	flags := flag.NewFlagSet("stdinsub", flag.ContinueOnError)
 	flags.SetOutput(inout.Stderr)
 	flags.Usage = func() {
-		fmt.Fprintf(inout.Stderr, `Usage: stdinsub < <minuend> <subtrahend1> <subtrahend2> ...
+		fmt.Fprintf(inout.Stderr, `Usage: stdinsub [-0] [-k <rule>] [-mk <rule>] [-sk <rule>] <subtrahend1> <subtrahend2> ... < <minuend>
 
 Subtract the second number from the first number.
+Lines are compared by the keys extracted by the rules. Minuend lines are printed verbatim.
+<rule> is one of the following, and can be specified several times to apply them in order:
+  basename           basename of the line
+  dirname            dirname of the line
+  noext              the line without extension
+  stem               basename of the line without extension
+  regex:<regexp>     the first capture group of the regexp, or the whole match if no groups
+  pattern:<pattern>  values of the variables in the path pattern such as "./input/{name}.tsv"
 
 Options:
 `)
@@ -47,13 +58,23 @@ Examples:
   $ stdinsub ./subtrahend1.txt ./subtrahend2.txt < ./minuend.txt 
   line 1
 
+  $ # Compare by basenames without extensions, so ./output/a.json drops ./input/a.tsv.
+  $ find ./input -name '*.tsv' -print0 | stdinsub -0 -k stem <(find ./output -name '*.json' -print0)
+  ./input/b.tsv
+  ...
+
+  $ # Compare by the variables in path patterns.
+  $ find ./input -name '*.tsv' -print0 | stdinsub -0 -mk 'pattern:./input/{name}.tsv' -sk 'pattern:./output/{name}.json' <(find ./output -name '*.json' -print0)
+  ./input/b.tsv
+  ...
+
   $ # It is useful to drop processed files from the input.
   $ find ./input -name '*.md' -print0 | stdinsub -0 <(find ./output -name '*.md' -print0 | sed -e 's|^\./input/|./output/|')
   ./input/file1.md
   ...
 
   $ # Process unprocessed ./input/*.md files in parallel using 3 processes by Claude Code.
-  $ stdinsub -0 <(find ./input -name '*.md' -print0) <(find ./output -name '*.md' -print0 | sed -e 's|^\./input/|./output/|') | stdinexec -0 bash -c 'claude -p < "{}"'
+  $ stdinsub -0 <(find ./input -name '*.md' -print0) <(find ./output -name '*.md' -print0 | sed -e 's|^\./input/|./output/|') | stdinexec -0 bash -c 'claude -p < {q}'
 `)
 	}
 
@@ -61,6 +82,15 @@ Examples:
 	tools.DeclareCommonFlags(flags, commonRawOptions)
 
 	null := flags.Bool("0", false, "use null byte as the record separator")
+	keyRules := make([]string, 0)
+	minuendKeyRules := make([]string, 0)
+	subtrahendKeyRules := make([]string, 0)
+	flags.Func("k", "key rule for both the minuend and the subtrahends", appendTo(&keyRules))
+	flags.Func("key", "key rule for both the minuend and the subtrahends", appendTo(&keyRules))
+	flags.Func("mk", "key rule for the minuend", appendTo(&minuendKeyRules))
+	flags.Func("minuend-key", "key rule for the minuend", appendTo(&minuendKeyRules))
+	flags.Func("sk", "key rule for the subtrahends", appendTo(&subtrahendKeyRules))
+	flags.Func("subtrahend-key", "key rule for the subtrahends", appendTo(&subtrahendKeyRules))
 
 	if err := flags.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
@@ -78,6 +108,16 @@ Examples:
 		return &Options{CommonOptions: commonOptions}, nil
 	}
 
+	minuendKey, err := parseKeyRules(append(slices.Clone(keyRules), minuendKeyRules...))
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid minuend key rule: %w", err)
+	}
+
+	subtrahendKey, err := parseKeyRules(append(slices.Clone(keyRules), subtrahendKeyRules...))
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid subtrahend key rule: %w", err)
+	}
+
 	subtrahends := make([]io.ReadCloser, flags.NArg())
 	for i := 0; i < flags.NArg(); i++ {
 		subtrahend, err := os.OpenFile(flags.Arg(i), os.O_RDONLY, 0644)
@@ -92,5 +132,26 @@ Examples:
 		Null:          *null,
 		Minuend:       inout.Stdin,
 		Subtrahends:   subtrahends,
+		MinuendKey:    minuendKey,
+		SubtrahendKey: subtrahendKey,
 	}, nil
 }
+
+func appendTo(ss *[]string) func(string) error {
+	return func(s string) error {
+		*ss = append(*ss, s)
+		return nil
+	}
+}
+
+func parseKeyRules(rules []string) (KeyFunc, error) {
+	fs := make([]KeyFunc, len(rules))
+	for i, rule := range rules {
+		f, err := ParseKeyRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		fs[i] = f
+	}
+	return ChainKeyFuncs(fs), nil
+}
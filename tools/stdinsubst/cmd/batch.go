@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/lines"
+	"github.com/Kuniwak/ai-cli-tools/replstr"
+	"github.com/Kuniwak/ai-cli-tools/testableio"
+)
+
+type BatchOptions struct {
+	Paths        io.Reader
+	Null         bool
+	OutDir       string
+	NameTemplate string
+}
+
+// RenderBatch renders the template once per input path read from options.Paths, and writes each result into
+// options.OutDir with the basename expanded from options.NameTemplate. Replacement strings such as "{}" and "{/.}"
+// in the replacement sources and the name template are expanded with the input path. They are quoted in command
+// sources, which are executed by shells.
+func RenderBatch(tmpl string, replacements []Replacement, options *BatchOptions, openFileFunc testableio.OpenFileFunc, inout *cli.ProcInout) error {
+	scanner := bufio.NewScanner(options.Paths)
+	scanner.Split(lines.NewScanFunc(options.Null))
+
+	seq := 0
+	for scanner.Scan() {
+		seq++
+		ctx := replstr.Context{Line: scanner.Text(), Seq: seq}
+
+		expanded := make([]Replacement, len(replacements))
+		for i, replacement := range replacements {
+			expand := replstr.Expand
+			if replacement.After.Kind == SourceCommand {
+				expand = replstr.ExpandShell
+			}
+			expanded[i] = Replacement{
+				Before: replacement.Before,
+				After:  Source{Kind: replacement.After.Kind, Value: expand(replacement.After.Value, ctx)},
+			}
+		}
+
+		rendered, err := Render(tmpl, expanded, inout)
+		if err != nil {
+			return fmt.Errorf("RenderBatch: %w (%q)", err, ctx.Line)
+		}
+
+		outPath := filepath.Join(options.OutDir, replstr.Expand(options.NameTemplate, ctx))
+		if err := writeFile(outPath, rendered, openFileFunc); err != nil {
+			return fmt.Errorf("RenderBatch: %w", err)
+		}
+
+		if err := lines.WriteLine(options.Null, outPath, inout.Stdout); err != nil {
+			return fmt.Errorf("RenderBatch: failed to write output path: %w", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("RenderBatch: failed to scan input paths: %w", err)
+	}
+	return nil
+}
+
+func writeFile(path string, content string, openFileFunc testableio.OpenFileFunc) error {
+	f, err := openFileFunc(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("writeFile: failed to open output file: %w", err)
+	}
+
+	if _, err := io.WriteString(f, content); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writeFile: failed to write output file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writeFile: failed to close output file: %w", err)
+	}
+	return nil
+}
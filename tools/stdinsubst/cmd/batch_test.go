@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/testableio"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderBatch(t *testing.T) {
+	testCases := map[string]struct {
+		tmpl           string
+		replacements   []Replacement
+		paths          string
+		null           bool
+		nameTemplate   string
+		expectedFiles  map[string]string
+		expectedStdout string
+	}{
+		"empty": {
+			tmpl:           "%%INPUT%%\n",
+			replacements:   []Replacement{{Before: "%%INPUT%%", After: Source{Kind: SourceLiteral, Value: "{}"}}},
+			paths:          "",
+			nameTemplate:   "{/}",
+			expectedFiles:  map[string]string{},
+			expectedStdout: "",
+		},
+		"several paths": {
+			tmpl:           "input: %%INPUT%%, output: %%OUTPUT%%\n",
+			replacements:   []Replacement{{Before: "%%INPUT%%", After: Source{Kind: SourceLiteral, Value: "{}"}}, {Before: "%%OUTPUT%%", After: Source{Kind: SourceLiteral, Value: "./output/{/.}.json"}}},
+			paths:          "./input/a.tsv\n./input/b.tsv\n",
+			nameTemplate:   "{/.}.md",
+			expectedFiles:  map[string]string{"prompt/a.md": "input: ./input/a.tsv, output: ./output/a.json\n", "prompt/b.md": "input: ./input/b.tsv, output: ./output/b.json\n"},
+			expectedStdout: "prompt/a.md\nprompt/b.md\n",
+		},
+		"null": {
+			tmpl:           "%%INPUT%%\n",
+			replacements:   []Replacement{{Before: "%%INPUT%%", After: Source{Kind: SourceLiteral, Value: "{/}"}}},
+			paths:          "./input/a.tsv\u0000./input/b.tsv\u0000",
+			null:           true,
+			nameTemplate:   "{#}.md",
+			expectedFiles:  map[string]string{"prompt/1.md": "a.tsv\n", "prompt/2.md": "b.tsv\n"},
+			expectedStdout: "prompt/1.md\u0000prompt/2.md\u0000",
+		},
+		"command with shell metacharacters": {
+			tmpl:           "%%NAME%%\n",
+			replacements:   []Replacement{{Before: "%%NAME%%", After: Source{Kind: SourceCommand, Value: "printf %s {/.}"}}},
+			paths:          "./input/a;echo PWNED>&2;$(id).tsv\n./input/it's.tsv\n",
+			nameTemplate:   "{#}.md",
+			expectedFiles:  map[string]string{"prompt/1.md": "a;echo PWNED>&2;$(id)\n", "prompt/2.md": "it's\n"},
+			expectedStdout: "prompt/1.md\nprompt/2.md\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout()
+			openFileSpy := testableio.NewSpyOpenFileFunc()
+			options := &BatchOptions{
+				Paths:        strings.NewReader(tc.paths),
+				Null:         tc.null,
+				OutDir:       "prompt",
+				NameTemplate: tc.nameTemplate,
+			}
+			if err := RenderBatch(tc.tmpl, tc.replacements, options, openFileSpy.OpenFileFunc(), spy.NewProcInout()); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(openFileSpy.Written(), tc.expectedFiles) {
+				t.Error(cmp.Diff(tc.expectedFiles, openFileSpy.Written()))
+			}
+			if spy.Stdout.String() != tc.expectedStdout {
+				t.Errorf("expected stdout to be %q, got %q", tc.expectedStdout, spy.Stdout.String())
+			}
+			if strings.Contains(spy.Stderr.String(), "PWNED") {
+				t.Errorf("expected the input path not to be executed, got stderr %q", spy.Stderr.String())
+			}
+		})
+	}
+}
+
+type failingCloser struct {
+	strings.Builder
+}
+
+func (f *failingCloser) Close() error {
+	return errors.New("disk full")
+}
+
+func TestRenderBatchCloseError(t *testing.T) {
+	spy := cli.SpyProcInout()
+	openFileFunc := func(path string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+		return &failingCloser{}, nil
+	}
+	options := &BatchOptions{Paths: strings.NewReader("./input/a.tsv\n"), OutDir: "prompt", NameTemplate: "{/}"}
+
+	err := RenderBatch("%%INPUT%%\n", nil, options, openFileFunc, spy.NewProcInout())
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected the close error, got %v", err)
+	}
+	if spy.Stdout.String() != "" {
+		t.Errorf("expected no paths to be printed, got %q", spy.Stdout.String())
+	}
+}
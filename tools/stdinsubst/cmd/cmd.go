@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/Kuniwak/ai-cli-tools/cli"
+	"github.com/Kuniwak/ai-cli-tools/testableio"
 	"github.com/Kuniwak/ai-cli-tools/version"
 )
 
@@ -33,20 +36,95 @@ func MainCommandByOptions(options *Options, inout *cli.ProcInout) error {
 		return nil
 	}
 
-	args := make([]string, len(options.Replacements)*2)
-	for i, replacement := range options.Replacements {
-		args[i*2] = replacement.Before
-		bs, err := os.ReadFile(replacement.After)
+	template := options.Template
+	if options.TemplateFile != "" {
+		f, err := os.Open(options.TemplateFile)
 		if err != nil {
-			return fmt.Errorf("MainCommandByOptions: failed to read replacement file: %w", err)
+			return fmt.Errorf("MainCommandByOptions: failed to open template file: %w at %q", err, options.TemplateFile)
 		}
-		args[i*2+1] = string(bs)
+		defer f.Close()
+		template = f
 	}
-	replacer := strings.NewReplacer(args...)
-	tmpl, err := io.ReadAll(options.Template)
+
+	tmpl, err := io.ReadAll(template)
 	if err != nil {
 		return fmt.Errorf("MainCommandByOptions: failed to read template: %w", err)
 	}
-	io.WriteString(inout.Stdout, replacer.Replace(string(tmpl)))
+
+	if options.Strict {
+		if err := ValidatePlaceholders(string(tmpl), options.Replacements, options.Placeholder); err != nil {
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+	}
+
+	if options.Batch != nil {
+		if err := os.MkdirAll(options.Batch.OutDir, 0755); err != nil {
+			return fmt.Errorf("MainCommandByOptions: failed to create output directory: %w", err)
+		}
+		if err := RenderBatch(string(tmpl), options.Replacements, options.Batch, testableio.NewOpenFileFunc(), inout); err != nil {
+			return fmt.Errorf("MainCommandByOptions: %w", err)
+		}
+		return nil
+	}
+
+	rendered, err := Render(string(tmpl), options.Replacements, inout)
+	if err != nil {
+		return fmt.Errorf("MainCommandByOptions: %w", err)
+	}
+	io.WriteString(inout.Stdout, rendered)
+	return nil
+}
+
+func Render(tmpl string, replacements []Replacement, inout *cli.ProcInout) (string, error) {
+	args := make([]string, len(replacements)*2)
+	for i, replacement := range replacements {
+		args[i*2] = replacement.Before
+		after, err := replacement.After.Resolve(inout)
+		if err != nil {
+			return "", fmt.Errorf("Render: %w", err)
+		}
+		args[i*2+1] = after
+	}
+	replacer := strings.NewReplacer(args...)
+	return replacer.Replace(tmpl), nil
+}
+
+// ValidatePlaceholders returns an error if the template has placeholders matched by the pattern that have no replacement,
+// or if the template does not contain some of the strings to replace.
+func ValidatePlaceholders(tmpl string, replacements []Replacement, placeholder *regexp.Regexp) error {
+	befores := make(map[string]struct{}, len(replacements))
+	for _, replacement := range replacements {
+		befores[replacement.Before] = struct{}{}
+	}
+
+	unresolved := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, match := range placeholder.FindAllString(tmpl, -1) {
+		if _, ok := befores[match]; ok {
+			continue
+		}
+		if _, ok := seen[match]; ok {
+			continue
+		}
+		seen[match] = struct{}{}
+		unresolved = append(unresolved, strconv.Quote(match))
+	}
+
+	unused := make([]string, 0)
+	for _, replacement := range replacements {
+		if !strings.Contains(tmpl, replacement.Before) {
+			unused = append(unused, strconv.Quote(replacement.Before))
+		}
+	}
+
+	if len(unresolved) > 0 && len(unused) > 0 {
+		return fmt.Errorf("unresolved placeholders: %s, unused replacements: %s", strings.Join(unresolved, ", "), strings.Join(unused, ", "))
+	}
+	if len(unresolved) > 0 {
+		return fmt.Errorf("unresolved placeholders: %s", strings.Join(unresolved, ", "))
+	}
+	if len(unused) > 0 {
+		return fmt.Errorf("unused replacements: %s", strings.Join(unused, ", "))
+	}
 	return nil
 }
@@ -75,6 +75,116 @@ func TestMainCommandByOptions(t *testing.T) {
 	}
 }
 
+func TestMainCommandByArgsStrict(t *testing.T) {
+	testCases := map[string]struct {
+		stdin              string
+		args               []StringGenerator
+		expectedExitStatus int
+		expected           string
+	}{
+		"all resolved": {
+			stdin:              "%%GREETING%%, %%NOUN%%!\n",
+			args:               []StringGenerator{constantString("-s"), constantString("%%GREETING%%"), filePath("hello.txt", "Hello"), constantString("%%NOUN%%"), filePath("world.txt", "World")},
+			expectedExitStatus: 0,
+			expected:           "Hello, World!\n",
+		},
+		"literal percent signs": {
+			stdin:              "%%GREETING%%: printf %s, 100%done, 50%off\n",
+			args:               []StringGenerator{constantString("-s"), constantString("%%GREETING%%"), filePath("hello.txt", "Hello")},
+			expectedExitStatus: 0,
+			expected:           "Hello: printf %s, 100%done, 50%off\n",
+		},
+		"unresolved placeholder": {
+			stdin:              "%%GREETING%%, %%NOUN%%!\n",
+			args:               []StringGenerator{constantString("-s"), constantString("%%GREETING%%"), filePath("hello.txt", "Hello")},
+			expectedExitStatus: 1,
+			expected:           "",
+		},
+		"unused replacement": {
+			stdin:              "%%GREETING%%!\n",
+			args:               []StringGenerator{constantString("-strict"), constantString("%%GREETING%%"), filePath("hello.txt", "Hello"), constantString("%%NOUN%%"), filePath("world.txt", "World")},
+			expectedExitStatus: 1,
+			expected:           "",
+		},
+		"custom placeholder": {
+			stdin:              "{{GREETING}}, %%NOUN%%!\n",
+			args:               []StringGenerator{constantString("-s"), constantString("-placeholder"), constantString(`\{\{[A-Z]+\}\}`), constantString("{{GREETING}}"), filePath("hello.txt", "Hello")},
+			expectedExitStatus: 0,
+			expected:           "Hello, %%NOUN%%!\n",
+		},
+		"unresolved custom placeholder": {
+			stdin:              "{{GREETING}}, {{NOUN}}!\n",
+			args:               []StringGenerator{constantString("-s"), constantString("-placeholder"), constantString(`\{\{[A-Z]+\}\}`), constantString("{{GREETING}}"), filePath("hello.txt", "Hello")},
+			expectedExitStatus: 1,
+			expected:           "",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout(tc.stdin)
+			exitStatus := MainCommandByArgs(renderString(tc.args, t.TempDir()), spy.NewProcInout())
+			if exitStatus != tc.expectedExitStatus {
+				t.Errorf("expected exit status to be %d, got %d\n%s", tc.expectedExitStatus, exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expected {
+				t.Errorf("expected stdout to be %q, got %q", tc.expected, spy.Stdout.String())
+			}
+		})
+	}
+}
+
+func TestMainCommandByArgsSources(t *testing.T) {
+	testCases := map[string]struct {
+		stdin    string
+		env      map[string]string
+		args     []StringGenerator
+		expected string
+	}{
+		"file prefix": {
+			stdin:    "%%GREETING%%!\n",
+			args:     []StringGenerator{constantString("%%GREETING%%"), prefixed("file:", filePath("hello.txt", "Hello"))},
+			expected: "Hello!\n",
+		},
+		"literal": {
+			stdin:    "%%GREETING%%!\n",
+			args:     []StringGenerator{constantString("%%GREETING%%"), constantString("literal:Hello")},
+			expected: "Hello!\n",
+		},
+		"env": {
+			stdin:    "%%GREETING%%!\n",
+			env:      map[string]string{"GREETING": "Hello"},
+			args:     []StringGenerator{constantString("%%GREETING%%"), constantString("env:GREETING")},
+			expected: "Hello!\n",
+		},
+		"command": {
+			stdin:    "%%GREETING%%!\n",
+			args:     []StringGenerator{constantString("%%GREETING%%"), constantString("cmd:printf Hello")},
+			expected: "Hello!\n",
+		},
+		"mixed": {
+			stdin:    "%%GREETING%%, %%NOUN%%!\n",
+			env:      map[string]string{"NOUN": "World"},
+			args:     []StringGenerator{constantString("%%GREETING%%"), filePath("hello.txt", "Hello"), constantString("%%NOUN%%"), constantString("env:NOUN")},
+			expected: "Hello, World!\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spy := cli.SpyProcInout(tc.stdin)
+			for k, v := range tc.env {
+				spy.Env[k] = v
+			}
+			exitStatus := MainCommandByArgs(renderString(tc.args, t.TempDir()), spy.NewProcInout())
+			if exitStatus != 0 {
+				t.Errorf("expected exit status to be 0, got %d\n%s", exitStatus, spy.Stderr.String())
+			}
+			if spy.Stdout.String() != tc.expected {
+				t.Errorf("expected stdout to be %q, got %q", tc.expected, spy.Stdout.String())
+			}
+		})
+	}
+}
+
 type StringGenerator func(outDir string) string
 
 func constantString(s string) StringGenerator {
@@ -98,6 +208,12 @@ func filePath(basename string, content string) StringGenerator {
 	}
 }
 
+func prefixed(prefix string, g StringGenerator) StringGenerator {
+	return func(outDir string) string {
+		return prefix + g(outDir)
+	}
+}
+
 func renderString(gs []StringGenerator, outDir string) []string {
 	rendered := make([]string, len(gs))
 	for i, g := range gs {
@@ -5,29 +5,56 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"regexp"
 
 	"github.com/Kuniwak/ai-cli-tools/cli"
 	"github.com/Kuniwak/ai-cli-tools/tools"
 )
 
+const DefaultPlaceholderPattern = `%%[A-Za-z0-9_]+%%`
+
 type Options struct {
 	CommonOptions tools.CommonOptions
-	Template      io.Reader
-	Replacements  []Replacement
+	// Template is read if TemplateFile is empty.
+	Template io.Reader
+	// TemplateFile is the path of the template file, or empty if the template is read from Template.
+	TemplateFile string
+	Replacements []Replacement
+	Strict       bool
+	Placeholder  *regexp.Regexp
+	// Batch is non-nil in batch mode.
+	Batch *BatchOptions
 }
 
 type Replacement struct {
 	Before string
-	After  string
+	After  Source
 }
 
 func ParseOptions(args []string, inout *cli.ProcInout) (*Options, error) {
 	flags := flag.NewFlagSet("stdinsubst", flag.ContinueOnError)
 	flags.SetOutput(inout.Stderr)
 	flags.Usage = func() {
-		fmt.Fprintf(inout.Stderr, `Usage: stdinsubst <before-string> <after-file-path> [<before-string> <after-file-path> ...] < <template>
-
-<before-string> and <after-file-path> are the strings to replace and the file path to read the replacement from.
+		fmt.Fprintf(inout.Stderr, `Usage: stdinsubst [-s [-placeholder <pattern>]] [-f <template>] <before-string> <after> [<before-string> <after> ...] < <template>
+       stdinsubst [-s [-placeholder <pattern>]] [-0] -f <template> -o <out-dir> [-t <name-template>] <before-string> <after> [<before-string> <after> ...] < <input-paths>
+
+<before-string> and <after> are the strings to replace and the source to read the replacement from.
+<after> is one of the following:
+  <file-path>, file:<file-path>  contents of the file
+  literal:<value>                the value itself
+  env:<name>                     value of the environment variable
+  cmd:<command>                  stdout of the command executed by "sh -c"
+
+In batch mode (-o), the template is rendered into <out-dir> for each input path of the stdin, and the written paths are
+printed. The following replacement strings in <after> and <name-template> are replaced with the input path:
+  {}    the input path
+  {.}   the input path without extension
+  {/}   basename of the input path
+  {//}  dirname of the input path
+  {/.}  basename of the input path without extension
+  {#}   sequence number of the input path
+
+See README.md for details of strict mode and batch mode.
 
 Options:
 `)
@@ -39,7 +66,7 @@ Examples:
   $ stdinsubst "%%INPUT_FILE%%" ./input-1.txt < ./prompt.md
 
   $ # Process ./input/*.md files in parallel using 3 processes by Claude Code.
-  $ find ./input -name '*.md' -print0 | stdinexec -0 bash -c 'stdinsubst "%%INPUT_FILE%%" "{}" < ./prompt.md | claude -p'
+  $ find ./input -name '*.md' -print0 | stdinexec -0 bash -c 'stdinsubst "%%INPUT_FILE%%" {q} < ./prompt.md | claude -p'
 
   $ # Substitute the "%%GREETING%%" and "%%NOUN%%" in the template with the contents of the "hello.txt" and "world.txt" files.
   $ echo '%%GREETING%%, %%NOUN%%!' | stdinsubst '%%GREETING%%' ./hello.txt '%%NOUN%%' ./world.txt
@@ -47,12 +74,40 @@ Examples:
   $ # Also, you can substitute the "%%GREETING%%" and "%%NOUN%%" in the template with the process substitution.
   $ echo '%%GREETING%%, %%NOUN%%!' | stdinsubst '%%GREETING%%' <(printf Hello) '%%NOUN%%' <(printf World)
   Hello, World!
+
+  $ # Substitute with a literal string, an environment variable and the output of a command.
+  $ echo '%%GREETING%%, %%NOUN%%! (%%DATE%%)' | stdinsubst '%%GREETING%%' literal:Hello '%%NOUN%%' env:USER '%%DATE%%' 'cmd:date +%%F | tr -d "\n"'
+  Hello, alice! (2025-01-01)
+
+  $ # Render ./prompt/<name>.md for each ./input/<name>.tsv and process them in parallel using 3 processes by Claude Code.
+  $ find ./input -name '*.tsv' -print0 \
+      | stdinsubst -0 -f ./prompt_template.md -o ./prompt -t '{/.}.md' '%%INPUT_TSV%%' '{}' '%%OUTPUT%%' 'literal:./output/{/.}.json' \
+      | parallel -j3 -0 'claude -p < "{}"'
+
+  $ # Fail if the template has a %%%%NAME%%%% placeholder without any replacement.
+  $ echo '%%%%GREETING%%%%, %%%%NOUN%%%%!' | stdinsubst -s '%%%%GREETING%%%%' <(printf Hello)
+  MainCommandByOptions: unresolved placeholders: "%%%%NOUN%%%%"
+
+  $ # Use {{NAME}} style placeholders in strict mode.
+  $ echo '{{GREETING}}, {{NOUN}}!' | stdinsubst -s -placeholder '\{\{[A-Z]+\}\}' '{{GREETING}}' <(printf Hello) '{{NOUN}}' <(printf World)
+  Hello, World!
 `)
 	}
 
 	commonRawOptions := &tools.CommonRawOptions{}
 	tools.DeclareCommonFlags(flags, commonRawOptions)
 
+	strictShort := flags.Bool("s", false, "fail on unresolved placeholders or unused replacements")
+	strictLong := flags.Bool("strict", false, "fail on unresolved placeholders or unused replacements")
+	placeholderPattern := flags.String("placeholder", DefaultPlaceholderPattern, "regular expression to detect placeholders in strict mode")
+	null := flags.Bool("0", false, "use null byte as the record separator of input paths and output paths in batch mode")
+	templateFileShort := flags.String("f", "", "template file path instead of the stdin (required in batch mode)")
+	templateFileLong := flags.String("template-file", "", "template file path instead of the stdin (required in batch mode)")
+	outDirShort := flags.String("o", "", "output directory (enables batch mode)")
+	outDirLong := flags.String("out-dir", "", "output directory (enables batch mode)")
+	nameTemplateShort := flags.String("t", "", "basename template of output files in batch mode (default: \"{/}\")")
+	nameTemplateLong := flags.String("template", "", "basename template of output files in batch mode (default: \"{/}\")")
+
 	if err := flags.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return &Options{CommonOptions: tools.CommonOptions{Help: true}}, nil
@@ -73,16 +128,72 @@ Examples:
 		return nil, fmt.Errorf("number of replacements must be even")
 	}
 
+	placeholder, err := regexp.Compile(*placeholderPattern)
+	if err != nil {
+		return nil, fmt.Errorf("ParseOptions: invalid placeholder pattern: %w", err)
+	}
+
 	replacements := make([]Replacement, len(flags.Args())/2)
 	for i := 0; i < flags.NArg(); i += 2 {
 		replacements[i/2] = Replacement{
 			Before: flags.Arg(i),
-			After:  flags.Arg(i + 1),
+			After:  ParseSource(flags.Arg(i + 1)),
+		}
+	}
+
+	var templateFile string
+	if *templateFileLong != "" {
+		templateFile = *templateFileLong
+	} else {
+		templateFile = *templateFileShort
+	}
+
+	var outDir string
+	if *outDirLong != "" {
+		outDir = *outDirLong
+	} else {
+		outDir = *outDirShort
+	}
+
+	var nameTemplate string
+	if *nameTemplateLong != "" {
+		nameTemplate = *nameTemplateLong
+	} else {
+		nameTemplate = *nameTemplateShort
+	}
+
+	if outDir == "" {
+		if nameTemplate != "" || *null {
+			return nil, fmt.Errorf("ParseOptions: -t and -0 are only available in batch mode")
 		}
+		return &Options{
+			Replacements: replacements,
+			Template:     inout.Stdin,
+			TemplateFile: templateFile,
+			Strict:       *strictShort || *strictLong,
+			Placeholder:  placeholder,
+		}, nil
+	}
+
+	if templateFile == "" {
+		return nil, fmt.Errorf("ParseOptions: template file is required in batch mode")
+	}
+
+	if nameTemplate == "" {
+		nameTemplate = "{/}"
 	}
 
 	return &Options{
 		Replacements: replacements,
 		Template:     inout.Stdin,
+		TemplateFile: templateFile,
+		Strict:       *strictShort || *strictLong,
+		Placeholder:  placeholder,
+		Batch: &BatchOptions{
+			Paths:        inout.Stdin,
+			Null:         *null,
+			OutDir:       outDir,
+			NameTemplate: nameTemplate,
+		},
 	}, nil
 }
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Kuniwak/ai-cli-tools/cli"
+)
+
+type SourceKind int
+
+const (
+	SourceFile SourceKind = iota
+	SourceLiteral
+	SourceEnv
+	SourceCommand
+)
+
+var sourcePrefixes = []struct {
+	prefix string
+	kind   SourceKind
+}{
+	{"file:", SourceFile},
+	{"literal:", SourceLiteral},
+	{"env:", SourceEnv},
+	{"cmd:", SourceCommand},
+}
+
+// Source is where a replacement string comes from.
+type Source struct {
+	Kind  SourceKind
+	Value string
+}
+
+// ParseSource parses "file:<path>", "literal:<value>", "env:<name>" or "cmd:<command>".
+// A string without any of these prefixes is treated as a file path.
+func ParseSource(s string) Source {
+	for _, p := range sourcePrefixes {
+		if value, ok := strings.CutPrefix(s, p.prefix); ok {
+			return Source{Kind: p.kind, Value: value}
+		}
+	}
+	return Source{Kind: SourceFile, Value: s}
+}
+
+func (s Source) Resolve(inout *cli.ProcInout) (string, error) {
+	switch s.Kind {
+	case SourceFile:
+		bs, err := os.ReadFile(s.Value)
+		if err != nil {
+			return "", fmt.Errorf("Source.Resolve: failed to read replacement file: %w", err)
+		}
+		return string(bs), nil
+	case SourceLiteral:
+		return s.Value, nil
+	case SourceEnv:
+		return inout.Env(s.Value), nil
+	case SourceCommand:
+		stdout := &bytes.Buffer{}
+		cmd := exec.Command("sh", "-c", s.Value)
+		cmd.Stdout = stdout
+		cmd.Stderr = inout.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("Source.Resolve: failed to execute replacement command: %w (%q)", err, s.Value)
+		}
+		return stdout.String(), nil
+	default:
+		panic(fmt.Sprintf("unknown source kind: %d", s.Kind))
+	}
+}